@@ -0,0 +1,302 @@
+package main_test
+
+import (
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jefflinse/melatonin-ext/exec"
+	"github.com/jefflinse/melatonin/json"
+	"github.com/jefflinse/melatonin/mt"
+)
+
+func TestExec(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(exec.KillBackground)
+
+	server := exec.Start("sh", "start a background process").
+		WithArgs("-c", `trap 'echo stopping; exit 0' TERM; echo ready; while true; do sleep 0.1; done`).
+		ReadyWhenOutputMatches(regexp.MustCompile(`ready`)).
+		WithReadyTimeout(5 * time.Second)
+
+	greet := exec.Run("sh").
+		WithArgs("-c", `echo "Hello, $NAME!"`).
+		ExpectExitCode(0)
+
+	config := filepath.Join(dir, "config.txt")
+	hooks := exec.NewTestContext().
+		BeforeAll(exec.HookFunc(func() error {
+			return os.WriteFile(config, []byte("debug=true\n"), 0644)
+		})).
+		AfterAll(exec.Run("rm").WithArgs(config).ExpectExitCode(0))
+
+	widgets := exec.NewTestContext()
+
+	hello, err := exec.GoBinary("./testdata/hello", exec.GoBuildOptions{
+		LDFlags: "-X main.version=1.2.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := filepath.Join(dir, "hello.cover")
+	covered, err := exec.GoBinary("./testdata/hello", exec.GoBuildOptions{Cover: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered.WithCoverProfile(profile)
+	t.Cleanup(func() { exec.CleanUpGoBinaries() })
+
+	runner := mt.NewTestRunner().WithContinueOnFailure(true)
+	runner.RunTestsT(t, []mt.TestCase{
+
+		exec.Run("echo", "test a local command").
+			WithArgs("Hello, World!").
+			ExpectExitCode(0).
+			ExpectStdout("Hello, World!\n").
+			ExpectStderr(""),
+
+		exec.Run("echo").
+			WithArgs("Hello, World!").
+			ExpectExitCode(0),
+
+		exec.Run("sh", "test output against substrings and patterns").
+			WithArgs("-c", "echo version 1.2.3; echo warning: deprecated >&2").
+			ExpectExitCode(0).
+			ExpectStdoutContains("version").
+			ExpectStdoutMatches(regexp.MustCompile(`\d+\.\d+\.\d+`)).
+			ExpectStdoutNotContains("error").
+			ExpectStderrContains("deprecated").
+			ExpectStderrNotContains("fatal").
+			ExpectStderrMatches(regexp.MustCompile(`^warning:`)),
+
+		exec.Run("echo", "test JSON output").
+			WithArgs(`{"name": "Bob", "age": 42}`).
+			ExpectExitCode(0).
+			ExpectStdoutJSON(json.Object{
+				"name": "Bob",
+			}),
+
+		exec.Run("echo", "test exact JSON output").
+			WithArgs(`{"name": "Bob", "age": 42}`).
+			ExpectExitCode(0).
+			ExpectExactStdoutJSON(json.Object{
+				"name": "Bob",
+				"age":  42,
+			}),
+
+		exec.Run("sh", "test output line by line").
+			WithArgs("-c", `printf 'banana\napple\ncherry\n'`).
+			ExpectExitCode(0).
+			ExpectLineCount(3).
+			ExpectStdoutLinesUnordered("apple", "banana", "cherry"),
+
+		exec.Run("sh", "test newline-delimited JSON logs").
+			WithArgs("-c", `echo '{"level":"info","msg":"starting"}' >&2; echo '{"level":"info","msg":"listening","port":8080}' >&2`).
+			ExpectExitCode(0).
+			ExpectStderrLineCount(2).
+			ExpectStderrJSONLine(json.Object{
+				"msg":  "listening",
+				"port": 8080,
+			}),
+
+		exec.Run("echo", "test output against a golden file").
+			WithArgs("Hello, World!").
+			ExpectExitCode(0).
+			ExpectStdoutGolden("testdata/hello.golden"),
+
+		exec.Run("sleep", "test a command that is expected to hang").
+			WithArgs("10").
+			WithTimeout(100 * time.Millisecond).
+			ExpectTimeout(),
+
+		exec.Run("sh", "test an interactive session").
+			WithArgs("-c", `printf "Name: "; read name; echo "Hello, $name!"`).
+			WaitFor(regexp.MustCompile(`Name: $`)).
+			SendLine("Bob").
+			WaitFor(regexp.MustCompile(`Hello, Bob!`)).
+			ExpectExitCode(0),
+
+		exec.Run("sh", "test a command attached to a terminal").
+			WithArgs("-c", `[ -t 1 ] && printf '\033[32mterminal\033[0m\n'`).
+			WithPTY(24, 80).
+			WithANSIStripped().
+			ExpectExitCode(0).
+			ExpectStdout("terminal\n"),
+
+		exec.Run("sh", "test files written by a command").
+			WithArgs("-c", "echo Hello > hello.txt && ln -s hello.txt link.txt").
+			WithWorkingDir(dir).
+			ExpectExitCode(0).
+			ExpectFileContents("hello.txt", "Hello\n").
+			ExpectFileMode("hello.txt", 0644).
+			ExpectSymlink("link.txt", "hello.txt").
+			ExpectNoFile("goodbye.txt"),
+
+		exec.Run("sh", "test a command in a sandbox").
+			WithArgs("-c", `cat src/main.txt && echo "home: $HOME" && touch "$HOME/.examplerc"`).
+			WithSandbox("testdata/project.txtar").
+			ExpectExitCode(0).
+			ExpectStdoutContains("Hello, World!").
+			ExpectFile("README.md"),
+
+		server,
+
+		exec.Run("echo", "test a command while a background process runs").
+			WithArgs("Hello, server!").
+			ExpectExitCode(0),
+
+		server.Stop("stop the background process").
+			ExpectExitCode(0).
+			ExpectStdout("ready\nstopping\n"),
+
+		exec.Pipe(
+			exec.Run("printf").WithArgs("banana\napple\ncherry\n"),
+			exec.Run("sort").ExpectExitCode(0),
+			exec.Run("head").WithArgs("-n", "1"),
+		).
+			Describe("test a pipeline of commands").
+			ExpectExitCode(0).
+			ExpectStdout("apple\n"),
+
+		exec.Run("echo", "test the resources used by a command").
+			WithArgs("Hello, World!").
+			ExpectExitCode(0).
+			ExpectDurationUnder(time.Second).
+			ExpectCPUTimeUnder(500 * time.Millisecond),
+
+		exec.Run("sh", "test a command that shuts down gracefully when interrupted").
+			WithArgs("-c", `trap 'echo interrupted; exit 0' INT; while true; do sleep 0.05; done`).
+			SendSignalAfter(os.Interrupt, 100*time.Millisecond).
+			WithTimeout(5 * time.Second).
+			ExpectExitCode(0).
+			ExpectStdout("interrupted\n"),
+
+		exec.Run("sleep", "test a command that is killed by a signal").
+			WithArgs("10").
+			SendSignalAfter(syscall.SIGTERM, 100*time.Millisecond).
+			ExpectSignal(syscall.SIGTERM),
+
+		greet.Clone().
+			Describe("test a command cloned from a template").
+			WithEnvVars(map[string]string{"NAME": "Alice"}).
+			ExpectStdout("Hello, Alice!\n"),
+
+		greet.Clone().
+			Describe("test a command cloned from a template, repeatedly").
+			WithEnvVars(map[string]string{"NAME": "Bob"}).
+			ExpectStdout("Hello, Bob!\n").
+			Repeat(3),
+
+		exec.NewTestContext().
+			WithSandbox("").
+			WithNormalizers(exec.ScrubSandboxDir, exec.ScrubUUIDs).
+			Run("sh", "test normalized output").
+			WithArgs("-c", "pwd; echo id=123e4567-e89b-12d3-a456-426614174000").
+			ExpectStdout("<SANDBOX>/work\nid=<UUID>\n"),
+
+		exec.NewTestContext().
+			WithEnvVars(map[string]string{"FIRST": "foo", "SECOND": "bar"}).
+			Run("env", "test layered environment variables").
+			WithEnvVars(map[string]string{"SECOND": "new bar"}).
+			WithoutEnvVars("FIRST").
+			ExpectStdout("SECOND=new bar\n"),
+
+		exec.Run("sh", "test a command that runs stubbed programs").
+			WithArgs("-c", `git push origin "$(git rev-parse HEAD | cut -c 1-6)" || echo push failed`).
+			WithStub("git",
+				exec.StubResponse{Args: "rev-parse *", Stdout: "abc123def456\n"},
+				exec.StubResponse{Args: "push *", Stderr: "rejected\n", ExitCode: 1},
+			).
+			ExpectStdout("push failed\n").
+			ExpectStderr("rejected\n").
+			ExpectStubCalledWith("git", "push", "origin", "abc123"),
+
+		exec.Run("sh", "test a command that calls a stubbed HTTP API").
+			WithArgs("-c", `curl -s -X POST -d '{"name":"widget"}' "$API_URL/items"`).
+			WithHTTPStub("API_URL",
+				exec.HTTPRoute{Method: "POST", Path: "/items", Status: 201, Body: `{"id":1}`},
+			).
+			ExpectStdout(`{"id":1}`).
+			ExpectHTTPRequest("POST", "/items", `{"name":"widget"}`),
+
+		hooks.Run("cat", "test a command with setup and teardown hooks").
+			WithArgs(config).
+			ExpectStdout("debug=true\n"),
+
+		hooks.Teardown(),
+
+		widgets.Run("echo", "capture a value from a command's output").
+			WithArgs("created widget w-42").
+			CaptureStdout("id", regexp.MustCompile(`widget (\S+)`)),
+
+		widgets.Run("echo", "use a captured value in arguments and expectations").
+			WithArgs(`{"id": "{{id}}", "tags": ["blue"]}`).
+			CaptureJSON("tag", "tags.0").
+			ExpectStdoutJSON(json.Object{
+				"id": "{{id}}",
+			}),
+
+		widgets.Run("sh", "use captured values in the environment and stdin").
+			WithArgs("-c", `echo "deleted $ID $(cat)"`).
+			WithEnvVars(map[string]string{"ID": "{{id}}"}).
+			WithStdin(strings.NewReader("{{tag}}")).
+			ExpectStdout("deleted w-42 blue\n"),
+
+		exec.Shell(`
+			echo "Hello, $1!" > greeting.txt
+			cat greeting.txt
+		`, "test a shell script").
+			WithArgs("greet", "World").
+			WithSandbox("").
+			ExpectExitCode(0).
+			ExpectStdout("Hello, World!\n").
+			ExpectFile("greeting.txt"),
+
+		hello.Run("", "test a Go binary built by the test").
+			ExpectExitCode(0).
+			ExpectStdout("Hello from Go!\n"),
+
+		hello.Run("hello").
+			WithArgs("version").
+			ExpectExitCode(0).
+			ExpectStdout("1.2.3\n"),
+
+		covered.Run("", "collect coverage from a Go binary").
+			ExpectExitCode(0).
+			ExpectStdout("Hello from Go!\n"),
+
+		covered.Run("hello").
+			WithArgs("version").
+			ExpectExitCode(0).
+			ExpectStdout("dev\n"),
+
+		covered.Teardown("write a coverage profile"),
+
+		exec.Run("grep").
+			WithArgs("-c", "hello/main.go", profile).
+			ExpectExitCode(0),
+
+		exec.Cmd(osexec.Command("echo", "A custom command!")).
+			ExpectExitCode(0).
+			ExpectStdout("A custom command!\n"),
+	})
+
+	scripts, err := exec.LoadScripts("testdata/scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helloScripts, err := hello.LoadScripts("testdata/hello-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts = append(scripts, helloScripts...)
+
+	runner.RunTestsT(t, scripts)
+}
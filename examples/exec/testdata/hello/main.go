@@ -0,0 +1,18 @@
+// Command hello is built by the exec examples to demonstrate GoBinary.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var version = "dev"
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(version)
+		return
+	}
+
+	fmt.Println("Hello from Go!")
+}
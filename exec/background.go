@@ -0,0 +1,412 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	osexec "os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	defaultReadyTimeout = 30 * time.Second
+	readinessInterval   = 50 * time.Millisecond
+)
+
+// A ReadinessCheck reports whether a background process is ready for use.
+type ReadinessCheck struct {
+	Desc  string
+	Ready func(stdout, stderr string) bool
+}
+
+// startContexts are the contexts created by the package-level Start, whose
+// background processes are killed by KillBackground.
+var (
+	startContextsMu sync.Mutex
+	startContexts   []*TestContext
+)
+
+// Start returns a test case that starts the command in the background using
+// the default context. See TestContext.Start.
+//
+// Each call uses a new default context, so no Teardown test case can reach
+// the process; use KillBackground to make sure it's killed if it's never
+// stopped.
+func Start(command string, description ...string) *TestCase {
+	c := DefaultContext()
+	startContextsMu.Lock()
+	startContexts = append(startContexts, c)
+	startContextsMu.Unlock()
+
+	return c.Start(command, description...)
+}
+
+// KillBackground kills every background process started by the package-level
+// Start, in any test, that hasn't been stopped. Register it as a cleanup
+// function so that processes are killed even if the test cases that would
+// stop them never run:
+//
+//	t.Cleanup(exec.KillBackground)
+func KillBackground() {
+	startContextsMu.Lock()
+	contexts := append([]*TestContext(nil), startContexts...)
+	startContextsMu.Unlock()
+
+	for _, c := range contexts {
+		c.KillBackground()
+	}
+}
+
+// Start returns a test case that starts the command in the background and
+// waits for it to become ready. The process keeps running while subsequent
+// test cases execute, until it is stopped by the test case returned by Stop,
+// or killed by the context's Teardown test case or KillBackground method.
+// A test runner that stops at the first failure skips any Stop and Teardown
+// test cases that follow it, and the process, which runs in its own process
+// group, outlives the test binary; register the context's KillBackground
+// method with t.Cleanup to make sure the process is killed.
+//
+// Timeouts, signals, dialogues and PTYs can't be used with a background
+// process.
+//
+// Expectations on the returned test case are checked against the output the
+// process produced before it became ready. Its exit code is -1 while it is
+// still running, so exit code expectations usually belong on the Stop test
+// case.
+func (c *TestContext) Start(command string, description ...string) *TestCase {
+	tc := c.Run(command, description...)
+	tc.Background = true
+	return tc
+}
+
+// Stop returns a test case that stops a background process started by this
+// test case. The process group is sent SIGTERM, followed by SIGKILL if the
+// process has not exited by the end of the grace period. Expectations on the
+// returned test case are checked against the process's exit code and all of
+// the output it produced while running. As with any other test case, a
+// process that exits unsuccessfully, including one killed by the SIGTERM
+// sent to stop it, fails unless the test case expects its exit code or
+// signal.
+func (tc *TestCase) Stop(description ...string) *TestCase {
+	desc := strings.Join(description, ", ")
+	if desc == "" {
+		desc = "stop " + tc.Description()
+	}
+
+	return &TestCase{
+		Desc:         desc,
+		Expectations: Expectations{},
+
+		spec:  tc.spec,
+		tctx:  tc.tctx,
+		stops: tc,
+	}
+}
+
+// ReadyWhenPortOpen waits for a TCP connection to addr to succeed before the
+// background process is considered ready.
+func (tc *TestCase) ReadyWhenPortOpen(addr string) *TestCase {
+	tc.Readiness = append(tc.Readiness, ReadinessCheck{
+		Desc: "port " + addr + " to be open",
+		Ready: func(string, string) bool {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err != nil {
+				return false
+			}
+
+			conn.Close()
+			return true
+		},
+	})
+
+	return tc
+}
+
+// ReadyWhenOutputMatches waits for the background process's stdout or stderr
+// to match pattern before it is considered ready.
+func (tc *TestCase) ReadyWhenOutputMatches(pattern *regexp.Regexp) *TestCase {
+	tc.Readiness = append(tc.Readiness, ReadinessCheck{
+		Desc: fmt.Sprintf("output to match /%s/", pattern),
+		Ready: func(stdout, stderr string) bool {
+			return pattern.MatchString(stdout) || pattern.MatchString(stderr)
+		},
+	})
+
+	return tc
+}
+
+// ReadyWhenHTTPOK waits for a GET request to url to return 200 OK before the
+// background process is considered ready.
+func (tc *TestCase) ReadyWhenHTTPOK(url string) *TestCase {
+	client := &http.Client{Timeout: time.Second}
+	tc.Readiness = append(tc.Readiness, ReadinessCheck{
+		Desc: "GET " + url + " to return 200 OK",
+		Ready: func(string, string) bool {
+			resp, err := client.Get(url)
+			if err != nil {
+				return false
+			}
+
+			resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		},
+	})
+
+	return tc
+}
+
+// WithReadyTimeout sets how long to wait for a background process to become
+// ready. The default is 30 seconds.
+func (tc *TestCase) WithReadyTimeout(timeout time.Duration) *TestCase {
+	tc.ReadyTimeout = timeout
+	return tc
+}
+
+// A backgroundProcess is a command started by a background test case.
+type backgroundProcess struct {
+	cmd      *osexec.Cmd
+	stdout   *outputBuffer
+	stderr   *outputBuffer
+	sandbox  *sandbox
+	stubs    *stubDir
+	servers  *httpServers
+	coverDir string
+	exited   chan struct{}
+	waitErr  error
+	duration time.Duration
+	stopped  bool
+}
+
+// kill kills the process group, if the process is still running, and waits
+// for it to exit.
+func (p *backgroundProcess) kill() {
+	if p.running() {
+		killProcessGroup(p.cmd.Process)
+		<-p.exited
+	}
+}
+
+// discard kills the process and removes its sandbox, stubs and servers.
+func (p *backgroundProcess) discard() {
+	p.stopped = true
+	p.kill()
+	if p.sandbox != nil {
+		p.sandbox.remove()
+	}
+
+	p.stubs.remove()
+	p.servers.close()
+}
+
+// addBackground records a background process started in the context, so
+// that it can be killed if it's never stopped.
+func (c *TestContext) addBackground(p *backgroundProcess) {
+	c.backgroundMu.Lock()
+	defer c.backgroundMu.Unlock()
+
+	c.background = append(c.background, p)
+}
+
+func (c *TestContext) removeBackground(p *backgroundProcess) {
+	c.backgroundMu.Lock()
+	defer c.backgroundMu.Unlock()
+
+	for i, bg := range c.background {
+		if bg == p {
+			c.background = append(c.background[:i], c.background[i+1:]...)
+			return
+		}
+	}
+}
+
+// KillBackground kills the context's background processes that haven't been
+// stopped.
+func (c *TestContext) KillBackground() {
+	c.backgroundMu.Lock()
+	background := c.background
+	c.background = nil
+	c.backgroundMu.Unlock()
+
+	for _, p := range background {
+		p.discard()
+	}
+}
+
+func (p *backgroundProcess) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (tc *TestCase) start(t *testing.T) (*TestResult, error) {
+	if tc.process != nil && !tc.process.stopped {
+		return nil, errors.New("background process is already running")
+	}
+
+	if tc.Timeout != 0 || len(tc.Signals) > 0 || len(tc.Dialogue) > 0 || tc.PTY != nil {
+		return nil, errors.New("timeouts, signals, dialogues and PTYs can't be used with a background process")
+	}
+
+	if tc.Repetitions > 1 {
+		return nil, errors.New("a background process can't be repeated")
+	}
+
+	result := &TestResult{
+		testCase: tc,
+	}
+
+	sandbox, err := tc.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := tc.cmd
+	result.Environment = cmd.Env
+	result.SandboxDir = sandbox.dir()
+	result.CoverDir = tc.coverDir
+	p := &backgroundProcess{
+		cmd:      cmd,
+		stdout:   &outputBuffer{},
+		stderr:   &outputBuffer{},
+		sandbox:  sandbox,
+		stubs:    tc.stubDir,
+		servers:  tc.servers,
+		coverDir: tc.coverDir,
+		exited:   make(chan struct{}),
+	}
+
+	cmd.Stdout, cmd.Stderr = p.stdout, p.stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		result.errors = append(result.errors, commandError(err))
+		tc.tearDownSandbox(t, sandbox, result)
+		p.stubs.remove()
+		p.servers.close()
+		return result, nil
+	}
+
+	tc.process = p
+	started := time.Now()
+	go func() {
+		p.waitErr = cmd.Wait()
+		p.duration = time.Since(started)
+		close(p.exited)
+	}()
+
+	// the process outlives this test case, so it's the context, rather than
+	// t, that kills it if it's never stopped
+	tc.tctx.addBackground(p)
+
+	// a process that never becomes ready can't be stopped, so it's cleaned up
+	// here instead
+	if err := tc.waitUntilReady(); err != nil {
+		result.errors = append(result.errors, err)
+		p.stopped = true
+		tc.tctx.removeBackground(p)
+		p.kill()
+	}
+
+	if p.running() {
+		result.ExitCode = -1
+	} else {
+		result.setProcessState(cmd.ProcessState, p.duration)
+	}
+
+	result.setOutput(p.stdout.String(), p.stderr.String())
+	result.recordStubCalls(p.stubs)
+	result.HTTPRequests = p.servers.received()
+	result.validateExpectations()
+	if p.stopped {
+		tc.tearDownSandbox(t, sandbox, result)
+		p.stubs.remove()
+		p.servers.close()
+	}
+
+	return result, nil
+}
+
+func (tc *TestCase) waitUntilReady() error {
+	timeout := tc.ReadyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	pending := tc.Readiness
+	for {
+		var notReady []ReadinessCheck
+		for _, check := range pending {
+			if !check.Ready(tc.process.stdout.String(), tc.process.stderr.String()) {
+				notReady = append(notReady, check)
+			}
+		}
+
+		if pending = notReady; len(pending) == 0 {
+			return nil
+		}
+
+		if !tc.process.running() {
+			return fmt.Errorf("process exited with code %d while waiting for %s", tc.cmd.ProcessState.ExitCode(), pending[0].Desc)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s", timeout, pending[0].Desc)
+		}
+
+		time.Sleep(readinessInterval)
+	}
+}
+
+func (tc *TestCase) stop(t *testing.T) (*TestResult, error) {
+	p := tc.stops.process
+	if p == nil {
+		return nil, errors.New("background process has not been started")
+	}
+
+	if p.stopped {
+		return nil, errors.New("background process has already been stopped")
+	}
+
+	tc.cmd = tc.stops.cmd
+
+	result := &TestResult{
+		SandboxDir: p.sandbox.dir(),
+		CoverDir:   p.coverDir,
+		testCase:   tc,
+	}
+
+	p.stopped = true
+	tc.tctx.removeBackground(p)
+	if p.running() {
+		terminateProcessGroup(tc.cmd.Process)
+		select {
+		case <-p.exited:
+		case <-time.After(tc.gracePeriod()):
+			killProcessGroup(tc.cmd.Process)
+			<-p.exited
+		}
+	}
+
+	if p.waitErr != nil && !tc.expectsExitStatus(p.waitErr) {
+		result.errors = append(result.errors, commandError(p.waitErr))
+	}
+
+	result.setProcessState(tc.cmd.ProcessState, p.duration)
+	result.setOutput(p.stdout.String(), p.stderr.String())
+	result.recordStubCalls(p.stubs)
+	result.HTTPRequests = p.servers.received()
+	result.validateExpectations()
+	tc.stops.tearDownSandbox(t, p.sandbox, result)
+	p.stubs.remove()
+	p.servers.close()
+
+	return result, nil
+}
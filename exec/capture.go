@@ -0,0 +1,347 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mtjson "github.com/jefflinse/melatonin/json"
+)
+
+// A Capture stores a value from a command's stdout in its context's
+// variables, under Name. The value is either the first submatch of Stdout
+// (or the whole match, if it has no groups) or the value at JSONPath in
+// stdout parsed as JSON.
+type Capture struct {
+	Name     string
+	Stdout   *regexp.Regexp
+	JSONPath string
+}
+
+// placeholderPattern matches a {{name}} placeholder.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// WithVariables sets variables that can be referred to as {{name}}
+// placeholders by test cases in this context. Variables are also set by
+// test cases that capture values from their output; see
+// TestCase.CaptureStdout.
+func (c *TestContext) WithVariables(vars map[string]string) *TestContext {
+	c.varsMu.Lock()
+	defer c.varsMu.Unlock()
+
+	if c.Variables == nil {
+		c.Variables = map[string]string{}
+	}
+
+	for k, v := range vars {
+		c.Variables[k] = v
+	}
+
+	return c
+}
+
+// Variable returns the value of the named variable, and whether it is set.
+func (c *TestContext) Variable(name string) (string, bool) {
+	c.varsMu.Lock()
+	defer c.varsMu.Unlock()
+
+	v, ok := c.Variables[name]
+	return v, ok
+}
+
+// CaptureStdout stores the first submatch of pattern in stdout, or the whole
+// match if pattern has no groups, in the context's variable name. Later test
+// cases in the same context can refer to it as {{name}} in their arguments,
+// environment, stdin and expectations. It is an error for pattern not to
+// match.
+//
+//	ctx := exec.NewTestContext()
+//
+//	mt.RunTestsT(t, []mt.TestCase{
+//		ctx.Run("mytool").
+//			WithArgs("create", "widget").
+//			CaptureStdout("id", regexp.MustCompile(`created (\w+)`)),
+//
+//		ctx.Run("mytool").
+//			WithArgs("delete", "{{id}}").
+//			ExpectStdout("deleted {{id}}\n"),
+//	})
+func (tc *TestCase) CaptureStdout(name string, pattern *regexp.Regexp) *TestCase {
+	tc.Captures = append(tc.Captures, &Capture{Name: name, Stdout: pattern})
+	return tc
+}
+
+// CaptureJSON stores the value at path in stdout, parsed as JSON, in the
+// context's variable name. See CaptureStdout. The path is a dot-separated
+// list of object keys and array indexes, such as "items.0.id". Strings are
+// stored as is, and other values as JSON. It is an error for stdout not to
+// be JSON or for the path not to exist.
+func (tc *TestCase) CaptureJSON(name, path string) *TestCase {
+	tc.Captures = append(tc.Captures, &Capture{Name: name, JSONPath: path})
+	return tc
+}
+
+// capture sets the context's variables from the test case's captures.
+func (r *TestResult) capture(stdout string) {
+	tc := r.TestCase().(*TestCase)
+	if len(tc.Captures) == 0 || tc.tctx == nil {
+		return
+	}
+
+	for _, c := range tc.Captures {
+		value, err := c.value(stdout)
+		if err != nil {
+			r.errors = append(r.errors, fmt.Errorf("capture %s: %w", c.Name, err))
+			continue
+		}
+
+		tc.tctx.WithVariables(map[string]string{c.Name: value})
+	}
+}
+
+func (c *Capture) value(stdout string) (string, error) {
+	if c.Stdout != nil {
+		m := c.Stdout.FindStringSubmatch(stdout)
+		if m == nil {
+			return "", fmt.Errorf("expected stdout to match /%s/, got %q", c.Stdout, stdout)
+		}
+
+		if len(m) > 1 {
+			return m[1], nil
+		}
+
+		return m[0], nil
+	}
+
+	var value interface{}
+	d := json.NewDecoder(strings.NewReader(stdout))
+	d.UseNumber()
+	if err := d.Decode(&value); err != nil {
+		return "", fmt.Errorf("expected stdout to be JSON: %w, got %q", err, stdout)
+	}
+
+	if c.JSONPath != "" {
+		for _, key := range strings.Split(c.JSONPath, ".") {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				field, ok := v[key]
+				if !ok {
+					return "", fmt.Errorf("%s not found in stdout", c.JSONPath)
+				}
+
+				value = field
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(v) {
+					return "", fmt.Errorf("%s not found in stdout", c.JSONPath)
+				}
+
+				value = v[i]
+			default:
+				return "", fmt.Errorf("%s not found in stdout", c.JSONPath)
+			}
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// expand replaces the {{name}} placeholders in s with the values of the
+// context's variables. Placeholders naming variables that aren't set are left
+// as is.
+func (c *TestContext) expand(s string) string {
+	if c == nil || !strings.Contains(s, "{{") {
+		return s
+	}
+
+	c.varsMu.Lock()
+	defer c.varsMu.Unlock()
+
+	return placeholderPattern.ReplaceAllStringFunc(s, func(p string) string {
+		name := placeholderPattern.FindStringSubmatch(p)[1]
+		if v, ok := c.Variables[name]; ok {
+			return v
+		}
+
+		return p
+	})
+}
+
+// expandEnv returns a copy of env with its values expanded.
+func (c *TestContext) expandEnv(env map[string]string) map[string]string {
+	expanded := make(map[string]string, len(env))
+	for k, v := range env {
+		expanded[k] = c.expand(v)
+	}
+
+	return expanded
+}
+
+// expandRegexp returns pattern with its placeholders replaced by the quoted
+// values of the context's variables.
+func (c *TestContext) expandRegexp(pattern *regexp.Regexp) *regexp.Regexp {
+	if c == nil || !strings.Contains(pattern.String(), "{{") {
+		return pattern
+	}
+
+	c.varsMu.Lock()
+	expr := placeholderPattern.ReplaceAllStringFunc(pattern.String(), func(p string) string {
+		name := placeholderPattern.FindStringSubmatch(p)[1]
+		if v, ok := c.Variables[name]; ok {
+			return regexp.QuoteMeta(v)
+		}
+
+		return p
+	})
+	c.varsMu.Unlock()
+
+	if expanded, err := regexp.Compile(expr); err == nil {
+		return expanded
+	}
+
+	return pattern
+}
+
+// expandJSON returns a copy of the expected JSON value v with placeholders in
+// its strings expanded.
+func (c *TestContext) expandJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return c.expand(v)
+	case map[string]interface{}:
+		return c.expandJSONObject(v)
+	case mtjson.Object:
+		return mtjson.Object(c.expandJSONObject(v))
+	case []interface{}:
+		return c.expandJSONArray(v)
+	case mtjson.Array:
+		return mtjson.Array(c.expandJSONArray(v))
+	default:
+		return v
+	}
+}
+
+func (c *TestContext) expandJSONObject(o map[string]interface{}) map[string]interface{} {
+	expanded := make(map[string]interface{}, len(o))
+	for k, v := range o {
+		expanded[k] = c.expandJSON(v)
+	}
+
+	return expanded
+}
+
+func (c *TestContext) expandJSONArray(a []interface{}) []interface{} {
+	expanded := make([]interface{}, len(a))
+	for i, v := range a {
+		expanded[i] = c.expandJSON(v)
+	}
+
+	return expanded
+}
+
+// expectations returns the test case's expectations with the placeholders
+// in their strings and patterns expanded.
+func (tc *TestCase) expectations() Expectations {
+	c := tc.tctx
+	e := tc.Expectations.clone()
+	if c == nil {
+		return e
+	}
+
+	e.Stdout = expandPtr(c, e.Stdout)
+	e.Stderr = expandPtr(c, e.Stderr)
+	expandAll(c, e.StdoutContains)
+	expandAll(c, e.StdoutNotContains)
+	expandAll(c, e.StderrContains)
+	expandAll(c, e.StderrNotContains)
+	expandAllRegexps(c, e.StdoutMatches)
+	expandAllRegexps(c, e.StderrMatches)
+	if e.StdoutJSON != nil {
+		e.StdoutJSON = c.expandJSON(e.StdoutJSON)
+	}
+
+	expandAll(c, e.StdoutLines)
+	expandAll(c, e.StderrLines)
+	for i, v := range e.StdoutJSONLines {
+		e.StdoutJSONLines[i] = c.expandJSON(v)
+	}
+
+	for i, v := range e.StderrJSONLines {
+		e.StderrJSONLines[i] = c.expandJSON(v)
+	}
+
+	for _, f := range e.Files {
+		f.Path = c.expand(f.Path)
+		f.Contents = expandPtr(c, f.Contents)
+		f.SymlinkTarget = expandPtr(c, f.SymlinkTarget)
+		expandAll(c, f.Contains)
+		expandAll(c, f.NotContains)
+		expandAllRegexps(c, f.Matches)
+		if f.JSON != nil {
+			f.JSON = c.expandJSON(f.JSON)
+		}
+	}
+
+	for i, s := range e.Stubs {
+		stub := *s
+		if s.Args != nil {
+			stub.Args = append([]string{}, s.Args...)
+			expandAll(c, stub.Args)
+		}
+
+		stub.Stdin = expandPtr(c, s.Stdin)
+		e.Stubs[i] = &stub
+	}
+
+	for i, r := range e.HTTPRequests {
+		req := *r
+		req.Path = c.expand(r.Path)
+		req.Body = c.expand(r.Body)
+		e.HTTPRequests[i] = &req
+	}
+
+	return e
+}
+
+// expandStdin returns stdin with its placeholders expanded. Input without
+// placeholders, including binary input, is returned unchanged.
+func (c *TestContext) expandStdin(stdin []byte) []byte {
+	if c == nil || !bytes.Contains(stdin, []byte("{{")) {
+		return stdin
+	}
+
+	return []byte(c.expand(string(stdin)))
+}
+
+func expandPtr(c *TestContext, s *string) *string {
+	if s == nil {
+		return nil
+	}
+
+	expanded := c.expand(*s)
+	return &expanded
+}
+
+func expandAll(c *TestContext, list []string) {
+	for i, s := range list {
+		list[i] = c.expand(s)
+	}
+}
+
+func expandAllRegexps(c *TestContext, list []*regexp.Regexp) {
+	for i, pattern := range list {
+		list[i] = c.expandRegexp(pattern)
+	}
+}
@@ -0,0 +1,93 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// WithCoverage collects coverage data from commands built with coverage
+// instrumentation (go build -cover). Each run of a test case in this context
+// is given its own GOCOVERDIR inside dir; WriteCoverProfile merges them.
+// Contexts returned by GoBinary with the Cover option collect coverage
+// automatically.
+func (c *TestContext) WithCoverage(dir string) *TestContext {
+	c.CoverDir = dir
+	return c
+}
+
+// WithCoverProfile causes the test case returned by Teardown to write the
+// merged coverage profile of the context's test cases to path. It has no
+// effect unless coverage is being collected.
+func (c *TestContext) WithCoverProfile(path string) *TestContext {
+	c.CoverProfile = path
+	return c
+}
+
+// WriteCoverProfile merges the coverage data collected from every run of the
+// context's test cases and writes it to path as a text profile, which can be
+// rendered with go tool cover.
+func (c *TestContext) WriteCoverProfile(path string) error {
+	if c.CoverDir == "" {
+		return errors.New("coverage is not being collected")
+	}
+
+	merged, err := os.MkdirTemp("", "melatonin-cover-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(merged)
+
+	// every run's counter files have unique names, and runs of the same
+	// binary share a meta-data file, so the files can be combined into a
+	// single directory without conflicts
+	counters := 0
+	err = filepath.WalkDir(c.CoverDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		if strings.HasPrefix(d.Name(), "covcounters.") {
+			counters++
+		}
+
+		return copyFile(path, filepath.Join(merged, d.Name()), 0644)
+	})
+	if err != nil {
+		return fmt.Errorf("merge coverage data: %w", err)
+	}
+
+	if counters == 0 {
+		return fmt.Errorf("no coverage data in %s; was the command built with -cover?", c.CoverDir)
+	}
+
+	cmd := osexec.Command("go", "tool", "covdata", "textfmt", "-i="+merged, "-o="+path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go tool covdata: %w\n%s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// newCoverDir creates the GOCOVERDIR for a run of the test case, if its
+// context is collecting coverage.
+func (tc *TestCase) newCoverDir() (string, error) {
+	if tc.tctx == nil || tc.tctx.CoverDir == "" {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(tc.tctx.CoverDir, 0755); err != nil {
+		return "", fmt.Errorf("create coverage directory: %w", err)
+	}
+
+	dir, err := os.MkdirTemp(tc.tctx.CoverDir, "run-")
+	if err != nil {
+		return "", fmt.Errorf("create coverage directory: %w", err)
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,404 @@
+package exec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A DiffConfig controls how mismatched output and file contents are shown
+// in failure messages.
+type DiffConfig struct {
+	// ContextLines is the number of unchanged lines shown around each change.
+	ContextLines int
+
+	// MaxLines is the maximum number of lines of a diff to show. Longer diffs
+	// are truncated. Zero means no limit.
+	MaxLines int
+}
+
+var defaultDiffConfig = DiffConfig{
+	ContextLines: 3,
+	MaxLines:     200,
+}
+
+// WithDiffContext sets the number of unchanged lines shown around each change
+// in diffs reported by test cases in this context. The default is 3.
+func (c *TestContext) WithDiffContext(lines int) *TestContext {
+	c.diff().ContextLines = lines
+	return c
+}
+
+// WithDiffLimit sets the maximum number of lines of each diff reported by
+// test cases in this context; zero means no limit. The default is 200.
+func (c *TestContext) WithDiffLimit(lines int) *TestContext {
+	c.diff().MaxLines = lines
+	return c
+}
+
+// WithDiffContext sets the number of unchanged lines shown around each change
+// in diffs reported by the test case.
+func (tc *TestCase) WithDiffContext(lines int) *TestCase {
+	tc.diff().ContextLines = lines
+	return tc
+}
+
+// WithDiffLimit sets the maximum number of lines of each diff reported by the
+// test case; zero means no limit.
+func (tc *TestCase) WithDiffLimit(lines int) *TestCase {
+	tc.diff().MaxLines = lines
+	return tc
+}
+
+func (c *TestContext) diff() *DiffConfig {
+	if c.Diff == nil {
+		cfg := defaultDiffConfig
+		c.Diff = &cfg
+	}
+
+	return c.Diff
+}
+
+func (tc *TestCase) diff() *DiffConfig {
+	if tc.Diff == nil {
+		cfg := tc.diffConfig()
+		tc.Diff = &cfg
+	}
+
+	return tc.Diff
+}
+
+func (tc *TestCase) diffConfig() DiffConfig {
+	if tc.Diff != nil {
+		return *tc.Diff
+	}
+
+	if tc.tctx != nil && tc.tctx.Diff != nil {
+		return *tc.tctx.Diff
+	}
+
+	return defaultDiffConfig
+}
+
+// mismatch returns an error describing how got differs from want. Values of
+// a single line are quoted; anything longer is shown as a unified diff.
+func (cfg DiffConfig) mismatch(name, want, got string) error {
+	if len(splitLines(want)) <= 1 && len(splitLines(got)) <= 1 {
+		return fmt.Errorf("expected %s %q, got %q", name, want, got)
+	}
+
+	return fmt.Errorf("%s does not match expected:\n%s", name, cfg.unifiedDiff("expected "+name, "actual "+name, want, got))
+}
+
+type diffOp struct {
+	kind byte // ' ', '-', or '+'
+	line string
+}
+
+// unifiedDiff returns a line-oriented unified diff between want and got,
+// or an empty string if they are identical. Whitespace at the end of changed
+// lines and carriage returns are made visible.
+func (cfg DiffConfig) unifiedDiff(wantName, gotName, want, got string) string {
+	if want == got {
+		return ""
+	}
+
+	ops := diffLines(splitLines(want), splitLines(got))
+
+	context := cfg.ContextLines
+	if context < 0 {
+		context = 0
+	}
+
+	b := &strings.Builder{}
+	for start := 0; start < len(ops); {
+		// find the next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+
+		// extend the hunk until there are more than 2*context unchanged lines in a row
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*context {
+				break
+			}
+		}
+
+		from, to := start-context, end+context
+		if from < 0 {
+			from = 0
+		}
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		writeHunk(b, ops, from, to)
+		start = to
+	}
+
+	return fmt.Sprintf("--- %s\n+++ %s\n", wantName, gotName) + truncateLines(b.String(), cfg.MaxLines)
+}
+
+// truncateLines limits s to max lines, noting how many lines were omitted.
+func truncateLines(s string, max int) string {
+	lines := splitLines(s)
+	if max <= 0 || len(lines) <= max {
+		return s
+	}
+
+	return strings.Join(lines[:max], "") + fmt.Sprintf("... (%d more lines)\n", len(lines)-max)
+}
+
+func writeHunk(b *strings.Builder, ops []diffOp, from, to int) {
+	wantStart, gotStart := 1, 1
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			wantStart++
+		}
+		if op.kind != '-' {
+			gotStart++
+		}
+	}
+
+	wantLen, gotLen := 0, 0
+	for _, op := range ops[from:to] {
+		if op.kind != '+' {
+			wantLen++
+		}
+		if op.kind != '-' {
+			gotLen++
+		}
+	}
+
+	fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(wantStart, wantLen), hunkRange(gotStart, gotLen))
+	for _, op := range ops[from:to] {
+		line := op.line
+		if op.kind != ' ' {
+			line = showWhitespace(line)
+		}
+
+		b.WriteByte(op.kind)
+		if strings.HasSuffix(line, "\n") {
+			b.WriteString(line)
+		} else {
+			b.WriteString(line + "\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// showWhitespace marks trailing spaces and tabs with '·' and '→', and
+// carriage returns with '␍', so that lines differing only in whitespace can
+// be told apart.
+func showWhitespace(line string) string {
+	text := strings.TrimSuffix(line, "\n")
+	eol := line[len(text):]
+	text = strings.ReplaceAll(text, "\r", "␍")
+
+	trimmed := strings.TrimRight(text, " \t")
+	trailing := strings.NewReplacer(" ", "·", "\t", "→").Replace(text[len(trimmed):])
+
+	return trimmed + trailing + eol
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+
+	return fmt.Sprintf("%d,%d", start, length)
+}
+
+// maxLCSCells limits the size of the table used to compute a minimal diff,
+// which needs memory proportional to the product of the inputs' lengths.
+const maxLCSCells = 4 << 20
+
+// diffLines computes an edit script between a and b. Lines common to the
+// start and end of both are matched first. If what remains is small enough,
+// a minimal edit script is computed from its longest common subsequence;
+// otherwise, lines that occur exactly once in both are used as anchors, as in
+// patience diff, and the sections between them are diffed in turn.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	switch {
+	case len(midA) == 0 || len(midB) == 0:
+		ops = appendReplace(ops, midA, midB)
+	case (len(midA)+1)*(len(midB)+1) <= maxLCSCells:
+		ops = appendLCSDiff(ops, midA, midB)
+	default:
+		ops = appendAnchoredDiff(ops, midA, midB)
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	return ops
+}
+
+// appendReplace appends an edit script that deletes all of a and inserts all
+// of b.
+func appendReplace(ops []diffOp, a, b []string) []diffOp {
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+
+	return ops
+}
+
+// appendLCSDiff appends a minimal edit script between a and b, computed from
+// their longest common subsequence.
+func appendLCSDiff(ops []diffOp, a, b []string) []diffOp {
+	// lcs[i*w+j] is the length of the LCS of a[i:] and b[j:]
+	w := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*w)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else if lcs[(i+1)*w+j] >= lcs[i*w+j+1] {
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			} else {
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+
+	return appendReplace(ops, a[i:], b[j:])
+}
+
+// appendAnchoredDiff appends an edit script between a and b that matches the
+// longest sequence of lines occurring exactly once in each, in the same
+// order, and diffs the sections between them. If there are no such lines,
+// all of a is replaced by all of b.
+func appendAnchoredDiff(ops []diffOp, a, b []string) []diffOp {
+	anchors := uniqueCommonLines(a, b)
+	if len(anchors) == 0 {
+		return appendReplace(ops, a, b)
+	}
+
+	i, j := 0, 0
+	for _, anchor := range anchors {
+		ops = append(ops, diffLines(a[i:anchor[0]], b[j:anchor[1]])...)
+		ops = append(ops, diffOp{' ', a[anchor[0]]})
+		i, j = anchor[0]+1, anchor[1]+1
+	}
+
+	return append(ops, diffLines(a[i:], b[j:])...)
+}
+
+// uniqueCommonLines returns the positions in a and b of the longest sequence
+// of lines that occur exactly once in each and appear in the same order in
+// both.
+func uniqueCommonLines(a, b []string) [][2]int {
+	type counts struct{ a, b, posA, posB int }
+	lines := map[string]*counts{}
+	for i, line := range a {
+		c := lines[line]
+		if c == nil {
+			c = &counts{}
+			lines[line] = c
+		}
+
+		c.a++
+		c.posA = i
+	}
+
+	for j, line := range b {
+		if c := lines[line]; c != nil {
+			c.b++
+			c.posB = j
+		}
+	}
+
+	// the unique lines, in the order they appear in a
+	var pairs [][2]int
+	for _, line := range a {
+		if c := lines[line]; c.a == 1 && c.b == 1 {
+			pairs = append(pairs, [2]int{c.posA, c.posB})
+		}
+	}
+
+	// find the longest subsequence of pairs that is increasing in b, using
+	// patience sorting: tails[k] is the index of the pair ending the best
+	// subsequence of length k+1 found so far
+	var tails []int
+	prev := make([]int, len(pairs))
+	for i, pair := range pairs {
+		k := sort.Search(len(tails), func(k int) bool { return pairs[tails[k]][1] > pair[1] })
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+
+	if len(tails) == 0 {
+		return nil
+	}
+
+	anchors := make([][2]int, len(tails))
+	for i, k := tails[len(tails)-1], len(tails)-1; k >= 0; i, k = prev[i], k-1 {
+		anchors[k] = pairs[i]
+	}
+
+	return anchors
+}
+
+// splitLines splits s into lines, keeping each line's trailing newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
@@ -0,0 +1,149 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DiffConfig
+		want string
+		got  string
+		diff string
+	}{
+		{
+			name: "identical",
+			cfg:  DiffConfig{ContextLines: 3},
+			want: "a\nb\n",
+			got:  "a\nb\n",
+			diff: "",
+		},
+		{
+			name: "changes separated by twice the context are merged",
+			cfg:  DiffConfig{ContextLines: 1},
+			want: "a\nb\nc\nd\ne\n",
+			got:  "a\nB\nc\nd\nE\n",
+			diff: "--- want\n+++ got\n" +
+				"@@ -1,5 +1,5 @@\n" +
+				" a\n-b\n+B\n c\n d\n-e\n+E\n",
+		},
+		{
+			name: "changes separated by more than twice the context are split",
+			cfg:  DiffConfig{ContextLines: 1},
+			want: "a\nb\nc\nd\ne\nf\n",
+			got:  "a\nB\nc\nd\ne\nF\n",
+			diff: "--- want\n+++ got\n" +
+				"@@ -1,3 +1,3 @@\n" +
+				" a\n-b\n+B\n c\n" +
+				"@@ -5,2 +5,2 @@\n" +
+				" e\n-f\n+F\n",
+		},
+		{
+			name: "no context",
+			cfg:  DiffConfig{ContextLines: 0},
+			want: "a\nb\nc\n",
+			got:  "a\nc\n",
+			diff: "--- want\n+++ got\n" +
+				"@@ -2 +1,0 @@\n" +
+				"-b\n",
+		},
+		{
+			name: "truncated to MaxLines",
+			cfg:  DiffConfig{ContextLines: 1, MaxLines: 2},
+			want: "a\nb\nc\nd\ne\n",
+			got:  "a\nB\nc\nd\nE\n",
+			diff: "--- want\n+++ got\n" +
+				"@@ -1,5 +1,5 @@\n" +
+				" a\n" +
+				"... (6 more lines)\n",
+		},
+		{
+			name: "missing trailing newline",
+			cfg:  DiffConfig{ContextLines: 3},
+			want: "a\nb\n",
+			got:  "a\nb",
+			diff: "--- want\n+++ got\n" +
+				"@@ -1,2 +1,2 @@\n" +
+				" a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			name: "trailing whitespace is shown",
+			cfg:  DiffConfig{ContextLines: 3},
+			want: "a\nb\n",
+			got:  "a\nb \n",
+			diff: "--- want\n+++ got\n" +
+				"@@ -1,2 +1,2 @@\n" +
+				" a\n-b\n+b·\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := tt.cfg.unifiedDiff("want", "got", tt.want, tt.got); diff != tt.diff {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", diff, tt.diff)
+			}
+		})
+	}
+}
+
+func TestShowWhitespace(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"a b\n", "a b\n"},
+		{"a  \n", "a··\n"},
+		{"a\t\n", "a→\n"},
+		{"a \t \n", "a·→·\n"},
+		{"a\r\n", "a␍\n"},
+		{"a ", "a·"},
+		{"\n", "\n"},
+	}
+
+	for _, tt := range tests {
+		if got := showWhitespace(tt.line); got != tt.want {
+			t.Errorf("showWhitespace(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDiffLinesLargeInput(t *testing.T) {
+	// large enough that the diff is anchored on unique lines instead of
+	// computed from a full LCS table
+	var a, b []string
+	for i := 0; i < 5000; i++ {
+		a = append(a, fmt.Sprintf("line %d\n", i))
+		if i%100 == 0 {
+			b = append(b, fmt.Sprintf("changed %d\n", i))
+		} else {
+			b = append(b, fmt.Sprintf("line %d\n", i))
+		}
+	}
+
+	ops := diffLines(a, b)
+
+	var gotA, gotB []string
+	changed := 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			gotA = append(gotA, op.line)
+		}
+		if op.kind != '-' {
+			gotB = append(gotB, op.line)
+		}
+		if op.kind != ' ' {
+			changed++
+		}
+	}
+
+	if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+		t.Fatal("edit script doesn't transform a into b")
+	}
+
+	if changed != 100 {
+		t.Errorf("got %d changed lines, want 100", changed)
+	}
+}
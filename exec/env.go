@@ -0,0 +1,129 @@
+package exec
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// environment returns the effective environment for the test case's command,
+// sorted by name. The environment is built up in layers, each overriding the
+// last:
+//
+//  1. the melatonin process's environment, if the context inherits it
+//  2. the sandbox's HOME, TMPDIR and XDG variables, if there is a sandbox
+//  3. the context's variables, with its unset variables removed
+//  4. the test case's variables, with its unset variables removed
+//
+// Placeholders in the values of the context's and test case's variables are
+// expanded.
+//
+// Finally, vars are set, such as the URLs of any HTTP stubs and the
+// coverage directory, and the directory containing the stubs, if any, is
+// prepended to PATH, or to the melatonin process's PATH if none is set.
+func (tc *TestCase) environment(s *sandbox, stubs *stubDir, vars map[string]string) []string {
+	env := map[string]string{}
+	if tc.tctx.InheritEnvironment {
+		for _, kv := range os.Environ() {
+			k, v := splitEnvVar(kv)
+			env[k] = v
+		}
+	}
+
+	if s != nil {
+		applyEnv(env, s.env(), nil)
+	}
+
+	applyEnv(env, tc.tctx.expandEnv(tc.tctx.Environment), tc.tctx.UnsetEnvironment)
+	applyEnv(env, tc.tctx.expandEnv(tc.Environment), tc.UnsetEnvironment)
+	applyEnv(env, vars, nil)
+
+	if stubs != nil {
+		// stubs stand in for some programs, not all of them, so the rest
+		// must still be found if the environment has no PATH of its own
+		path, ok := env["PATH"]
+		if !ok {
+			path = os.Getenv("PATH")
+		}
+
+		env["PATH"] = stubs.bin()
+		if path != "" {
+			env["PATH"] += string(os.PathListSeparator) + path
+		}
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	environ := make([]string, len(keys))
+	for i, k := range keys {
+		environ[i] = k + "=" + env[k]
+	}
+
+	return environ
+}
+
+func applyEnv(env map[string]string, set map[string]string, unset []string) {
+	for k, v := range set {
+		env[k] = v
+	}
+
+	for _, k := range unset {
+		delete(env, k)
+	}
+}
+
+// setEnv adds vars to a layer of the environment, returning the layer's
+// updated variables and unset variables.
+func setEnv(env map[string]string, unset []string, vars map[string]string) (map[string]string, []string) {
+	if env == nil {
+		env = map[string]string{}
+	}
+
+	for k, v := range vars {
+		env[k] = v
+		unset = removeKey(unset, k)
+	}
+
+	return env, unset
+}
+
+// unsetEnv removes keys from a layer of the environment, returning the
+// layer's updated variables and unset variables.
+func unsetEnv(env map[string]string, unset []string, keys []string) (map[string]string, []string) {
+	for _, k := range keys {
+		delete(env, k)
+		unset = append(removeKey(unset, k), k)
+	}
+
+	return env, unset
+}
+
+// removeKey returns a copy of keys without key.
+func removeKey(keys []string, key string) []string {
+	var kept []string
+	for _, k := range keys {
+		if k != key {
+			kept = append(kept, k)
+		}
+	}
+
+	return kept
+}
+
+// splitEnvVar splits a "key=value" environment variable. A leading "=" is
+// considered part of the key, as in the Windows "=C:=C:\" variables.
+func splitEnvVar(kv string) (string, string) {
+	if kv == "" {
+		return "", ""
+	}
+
+	if i := strings.Index(kv[1:], "="); i >= 0 {
+		return kv[:i+1], kv[i+2:]
+	}
+
+	return kv, ""
+}
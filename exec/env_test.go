@@ -0,0 +1,65 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitEnvVar(t *testing.T) {
+	tests := []struct {
+		kv    string
+		key   string
+		value string
+	}{
+		{"", "", ""},
+		{"KEY=value", "KEY", "value"},
+		{"KEY=", "KEY", ""},
+		{"KEY", "KEY", ""},
+		{"KEY=a=b", "KEY", "a=b"},
+		{`=C:=C:\`, "=C:", `C:\`},
+	}
+
+	for _, tt := range tests {
+		key, value := splitEnvVar(tt.kv)
+		if key != tt.key || value != tt.value {
+			t.Errorf("splitEnvVar(%q) = %q, %q, want %q, %q", tt.kv, key, value, tt.key, tt.value)
+		}
+	}
+}
+
+func TestSetAndUnsetEnv(t *testing.T) {
+	env, unset := setEnv(nil, nil, map[string]string{"A": "1", "B": "2"})
+	env, unset = unsetEnv(env, unset, []string{"A", "C"})
+	env, unset = unsetEnv(env, unset, []string{"C"})
+
+	if want := map[string]string{"B": "2"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+
+	if want := []string{"A", "C"}; !reflect.DeepEqual(unset, want) {
+		t.Errorf("unset = %q, want %q", unset, want)
+	}
+
+	env, unset = setEnv(env, unset, map[string]string{"A": "3"})
+
+	if want := map[string]string{"A": "3", "B": "2"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+
+	if want := []string{"C"}; !reflect.DeepEqual(unset, want) {
+		t.Errorf("unset = %q, want %q", unset, want)
+	}
+}
+
+func TestCloneEnvironment(t *testing.T) {
+	orig := Run("env").WithoutEnvVars("A", "B")
+	orig.Clone().WithEnvVars(map[string]string{"A": "1"})
+
+	if want := []string{"A", "B"}; !reflect.DeepEqual(orig.UnsetEnvironment, want) {
+		t.Errorf("original's unset variables = %q, want %q", orig.UnsetEnvironment, want)
+	}
+
+	if len(orig.Environment) > 0 {
+		t.Errorf("original's variables = %v, want none", orig.Environment)
+	}
+}
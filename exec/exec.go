@@ -1,19 +1,72 @@
 package exec
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	osexec "os/exec"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/jefflinse/melatonin/expect"
 	"github.com/jefflinse/melatonin/mt"
 )
 
+const defaultGracePeriod = 5 * time.Second
+
 type TestContext struct {
-	Environment []string
+	// InheritEnvironment causes commands to start with the environment of
+	// the melatonin process. Environment and UnsetEnvironment are applied
+	// on top of it, followed by the environment of each test case.
+	InheritEnvironment bool
+	Environment        map[string]string
+	UnsetEnvironment   []string
+
+	Timeout     time.Duration
+	GracePeriod time.Duration
+	Sandbox     *SandboxConfig
+	Diff        *DiffConfig
+	Normalizers []Normalizer
+	Stubs       []*Stub
+
+	// ShellCommand is the command used to run scripts passed to Shell.
+	ShellCommand []string
+
+	// Binary is the program run by Run when it is given an empty command or
+	// the binary's name. See GoBinary.
+	Binary string
+
+	// CoverDir is the directory in which coverage data is collected from
+	// commands built with coverage instrumentation, and CoverProfile is
+	// where Teardown writes the merged profile. See WithCoverage.
+	CoverDir     string
+	CoverProfile string
+
+	// Variables holds the values that test cases can refer to as {{name}}
+	// placeholders, including those captured from the output of earlier
+	// test cases. See TestCase.CaptureStdout.
+	Variables map[string]string
+
+	BeforeAllHooks  []Hook
+	BeforeEachHooks []Hook
+	AfterEachHooks  []Hook
+	AfterAllHooks   []Hook
+
+	keepSandbox     bool
+	hooksMu         sync.Mutex
+	ranBeforeAll    bool
+	beforeAllErrors []error
+	varsMu          sync.Mutex
+	backgroundMu    sync.Mutex
+	background      []*backgroundProcess
 }
 
 func DefaultContext() *TestContext {
@@ -22,39 +75,121 @@ func DefaultContext() *TestContext {
 
 func NewTestContext() *TestContext {
 	return &TestContext{
-		Environment: []string{},
+		Environment: map[string]string{},
 	}
 }
 
 func (c *TestContext) WithEnvVars(env map[string]string) *TestContext {
-	for k, v := range env {
-		c.Environment = append(c.Environment, k+"="+v)
-	}
+	c.Environment, c.UnsetEnvironment = setEnv(c.Environment, c.UnsetEnvironment, env)
+	return c
+}
 
+// WithoutEnvVars removes the given variables from the environment of test
+// cases in this context, including any inherited from the melatonin process.
+func (c *TestContext) WithoutEnvVars(keys ...string) *TestContext {
+	c.Environment, c.UnsetEnvironment = unsetEnv(c.Environment, c.UnsetEnvironment, keys)
 	return c
 }
 
 func (c *TestContext) WithInheritedEnvironment(inherit bool) *TestContext {
-	if inherit {
-		c.Environment = os.Environ()
-	} else {
-		c.Environment = []string{}
-	}
+	c.InheritEnvironment = inherit
+	return c
+}
 
+// WithTimeout sets the maximum time each test case in this context may run
+// before its process group is sent SIGTERM.
+func (c *TestContext) WithTimeout(timeout time.Duration) *TestContext {
+	c.Timeout = timeout
 	return c
 }
 
+// WithGracePeriod sets how long a timed out process group is given to exit
+// after SIGTERM before it is sent SIGKILL.
+func (c *TestContext) WithGracePeriod(gracePeriod time.Duration) *TestContext {
+	c.GracePeriod = gracePeriod
+	return c
+}
+
+// A ScheduledSignal is sent to a command's process once it has been running
+// for the given amount of time.
+type ScheduledSignal struct {
+	Signal os.Signal
+	After  time.Duration
+}
+
 type TestCase struct {
 	Desc         string
 	Expectations Expectations
+	Timeout      time.Duration
+	GracePeriod  time.Duration
+	Dialogue     []DialogueStep
+	StepTimeout  time.Duration
+	PTY          *PTYConfig
+	StripANSI    bool
+	Sandbox      *SandboxConfig
+	Diff         *DiffConfig
+	Normalizers  []Normalizer
+	Stubs        []*Stub
+	HTTPStubs    []*HTTPStub
+	Background   bool
+	Readiness    []ReadinessCheck
+	ReadyTimeout time.Duration
+	Pipeline     []*TestCase
+	Signals      []ScheduledSignal
+	Repetitions  int
+
+	// Script is the script run by a test case created with Shell.
+	Script string
 
-	cmd  *osexec.Cmd
-	tctx *TestContext
+	// Captures are the values stored in the context's variables from the
+	// test case's output.
+	Captures []*Capture
+
+	// Environment and UnsetEnvironment are applied on top of the
+	// environment of the test case's context.
+	Environment      map[string]string
+	UnsetEnvironment []string
+
+	// spec is the template from which a fresh command is created each time
+	// the test case is executed, and cmd is the command for the current run.
+	// The spec's stdin is buffered in stdin.
+	spec      *osexec.Cmd
+	stdin     *stdinBuffer
+	cmd       *osexec.Cmd
+	stubDir   *stubDir
+	servers   *httpServers
+	coverDir  string
+	tctx      *TestContext
+	process   *backgroundProcess
+	stops     *TestCase
+	tearsDown bool
+
+	// keepSandbox is set by KeepSandboxOnFailure.
+	keepSandbox bool
+
+	// sharedSandbox is the sandbox the test case shares with others, such
+	// as the other commands of its test script. resetsSandbox is set on the
+	// first test case to use it, and releasesSandbox on the last.
+	sharedSandbox   *sharedSandbox
+	resetsSandbox   bool
+	releasesSandbox bool
 }
 
 var _ mt.TestCase = &TestCase{}
 
 func (tc *TestCase) Action() string {
+	if tc.tearsDown {
+		return "TEARDOWN"
+	}
+
+	if tc.stops != nil {
+		return "STOP"
+	}
+
+	if tc.Background {
+		return "START"
+	}
+
 	return "EXEC"
 }
 
@@ -63,48 +198,599 @@ func (tc *TestCase) Description() string {
 		return tc.Desc
 	}
 
-	return tc.cmd.String()
+	if tc.Pipeline != nil || tc.Script != "" {
+		return tc.Target()
+	}
+
+	return tc.spec.String()
 }
 
 func (tc *TestCase) Execute(t *testing.T) (mt.TestResult, error) {
+	if tc.tearsDown {
+		return tc.tctx.tearDown(t, tc), nil
+	}
+
+	if errs := tc.tctx.runBeforeHooks(t); len(errs) > 0 {
+		return &TestResult{testCase: tc, errors: errs}, nil
+	}
+
+	result, err := tc.execute(t)
+	afterErrs := tc.tctx.runAfterEachHooks(t)
+	if err != nil {
+		return nil, err
+	}
+
+	result.errors = append(result.errors, afterErrs...)
+	return result, nil
+}
+
+// execute executes the test case without running its context's hooks.
+func (tc *TestCase) execute(t *testing.T) (*TestResult, error) {
+	if tc.stops != nil {
+		return tc.stop(t)
+	}
+
+	if tc.Background {
+		return tc.start(t)
+	}
+
+	if tc.Repetitions > 1 {
+		return tc.repeat(t)
+	}
+
+	return tc.executeOnce(t)
+}
+
+func (tc *TestCase) executeOnce(t *testing.T) (*TestResult, error) {
+	if tc.Pipeline != nil {
+		return tc.runPipeline(t)
+	}
+
 	result := &TestResult{
 		testCase: tc,
 	}
 
-	stdout, stderr := &strings.Builder{}, &strings.Builder{}
+	sandbox, err := tc.prepare()
+	if err != nil {
+		return nil, err
+	}
+	defer tc.tearDownSandbox(t, sandbox, result)
+	defer tc.stubDir.remove()
+	defer tc.servers.close()
+
+	result.Environment = tc.cmd.Env
+	result.SandboxDir = sandbox.dir()
+	result.CoverDir = tc.coverDir
+	stdout, stderr := &outputBuffer{}, &strings.Builder{}
 	tc.cmd.Stdout = stdout
 	tc.cmd.Stderr = stderr
 
-	if err := tc.cmd.Run(); err != nil {
-		switch e := err.(type) {
-		case *fs.PathError:
-			result.errors = append(result.errors, fmt.Errorf("%s: %s", e.Path, e.Err))
-		default:
-			result.errors = append(result.errors, err)
-		}
+	started := time.Now()
+	if err := tc.run(result, stdout); err != nil && !result.TimedOut && !tc.expectsExitStatus(err) {
+		result.errors = append(result.errors, commandError(err))
 	}
 
-	result.ExitCode = tc.cmd.ProcessState.ExitCode()
-	result.Stdout = stdout.String()
-	result.Stderr = stderr.String()
+	result.setProcessState(tc.cmd.ProcessState, time.Since(started))
+	result.setOutput(stdout.String(), stderr.String())
+	result.recordStubCalls(tc.stubDir)
+	result.HTTPRequests = tc.servers.received()
+
 	result.validateExpectations()
 
 	return result, nil
 }
 
+// repeat executes the test case repeatedly, returning the result of the last
+// run along with the errors from every run.
+func (tc *TestCase) repeat(t *testing.T) (*TestResult, error) {
+	var runs []*TestResult
+	for i := 0; i < tc.Repetitions; i++ {
+		run, err := tc.executeOnce(t)
+		if err != nil {
+			return nil, fmt.Errorf("run %d: %w", i+1, err)
+		}
+
+		runs = append(runs, run)
+	}
+
+	result := *runs[len(runs)-1]
+	result.Runs = runs
+	result.errors = nil
+	for i, run := range runs {
+		for _, err := range run.errors {
+			result.errors = append(result.errors, fmt.Errorf("run %d: %w", i+1, err))
+		}
+	}
+
+	return &result, nil
+}
+
+// prepare creates fresh commands for the test case, or for each stage of a
+// pipeline, sets up the sandbox, stubs and HTTP stubs they run with, and sets
+// their environments.
+func (tc *TestCase) prepare() (*sandbox, error) {
+	cases := tc.Pipeline
+	if cases == nil {
+		cases = []*TestCase{tc}
+	}
+
+	for _, c := range cases {
+		cmd, err := c.newCmd()
+		if err != nil {
+			return nil, err
+		}
+
+		c.cmd = cmd
+	}
+
+	// file expectations are resolved against the last command's working
+	// directory
+	tc.cmd = cases[len(cases)-1].cmd
+
+	sandbox, err := tc.setUpSandbox()
+	if err != nil {
+		return nil, err
+	}
+
+	tc.stubDir, err = newStubDir(tc.stubs(), tc.stubStdin())
+	if err != nil {
+		tc.discardSandbox(sandbox, true)
+		return nil, err
+	}
+
+	tc.coverDir, err = tc.newCoverDir()
+	if err != nil {
+		tc.discardSandbox(sandbox, true)
+		tc.stubDir.remove()
+		return nil, err
+	}
+
+	vars := map[string]string{}
+	tc.servers = startHTTPServers(tc.httpStubs())
+	if tc.servers != nil {
+		applyEnv(vars, tc.servers.env, nil)
+	}
+
+	if tc.coverDir != "" {
+		vars["GOCOVERDIR"] = tc.coverDir
+	}
+
+	for _, c := range cases {
+		c.cmd.Env = c.environment(sandbox, tc.stubDir, vars)
+	}
+
+	return sandbox, nil
+}
+
+// newCmd creates a fresh command from the test case's spec.
+func (tc *TestCase) newCmd() (*osexec.Cmd, error) {
+	// the spec is never run, so it's safe to copy
+	cmd := *tc.spec
+	cmd.Args = append([]string(nil), tc.spec.Args...)
+	for i := 1; i < len(cmd.Args); i++ {
+		cmd.Args[i] = tc.tctx.expand(cmd.Args[i])
+	}
+
+	if tc.spec.SysProcAttr != nil {
+		attr := *tc.spec.SysProcAttr
+		cmd.SysProcAttr = &attr
+	}
+
+	if tc.stdin != nil {
+		stdin, err := tc.stdin.read()
+		if err != nil {
+			return nil, fmt.Errorf("read stdin: %w", err)
+		}
+
+		cmd.Stdin = bytes.NewReader(tc.tctx.expandStdin(stdin))
+	}
+
+	return &cmd, nil
+}
+
+// A stdinBuffer reads a test case's stdin in full when it's first run, so that
+// every run and every clone of the test case receives the same input.
+type stdinBuffer struct {
+	once   sync.Once
+	reader io.Reader
+	data   []byte
+	err    error
+}
+
+func (b *stdinBuffer) read() ([]byte, error) {
+	b.once.Do(func() {
+		b.data, b.err = io.ReadAll(b.reader)
+		b.reader = nil
+	})
+
+	return b.data, b.err
+}
+
+// Clone returns a copy of the test case that can be modified and executed
+// independently of the original, for example to run the same command with
+// different arguments or environments.
+func (tc *TestCase) Clone() *TestCase {
+	c := *tc
+	c.cmd = nil
+	c.process = nil
+	c.Expectations = tc.Expectations.clone()
+	c.Dialogue = append([]DialogueStep(nil), tc.Dialogue...)
+	c.Readiness = append([]ReadinessCheck(nil), tc.Readiness...)
+	c.Signals = append([]ScheduledSignal(nil), tc.Signals...)
+	c.Normalizers = append([]Normalizer(nil), tc.Normalizers...)
+	c.Captures = append([]*Capture(nil), tc.Captures...)
+	c.Stubs = nil
+	for _, s := range tc.Stubs {
+		stub := *s
+		stub.Responses = append([]StubResponse(nil), s.Responses...)
+		c.Stubs = append(c.Stubs, &stub)
+	}
+
+	c.HTTPStubs = nil
+	for _, s := range tc.HTTPStubs {
+		stub := *s
+		stub.Routes = append([]HTTPRoute(nil), s.Routes...)
+		c.HTTPStubs = append(c.HTTPStubs, &stub)
+	}
+
+	c.Environment, c.UnsetEnvironment = setEnv(nil, append([]string(nil), tc.UnsetEnvironment...), tc.Environment)
+
+	if tc.spec != nil {
+		spec := *tc.spec
+		spec.Args = append([]string(nil), tc.spec.Args...)
+		c.spec = &spec
+	}
+
+	if tc.PTY != nil {
+		pty := *tc.PTY
+		c.PTY = &pty
+	}
+
+	if tc.Sandbox != nil {
+		sandbox := *tc.Sandbox
+		c.Sandbox = &sandbox
+	}
+
+	if tc.Diff != nil {
+		diff := *tc.Diff
+		c.Diff = &diff
+	}
+
+	if tc.Pipeline != nil {
+		c.Pipeline = make([]*TestCase, len(tc.Pipeline))
+		for i, stage := range tc.Pipeline {
+			c.Pipeline[i] = stage.Clone()
+		}
+	}
+
+	return &c
+}
+
+// Repeat executes the command n times each time the test case is executed.
+// Every run must meet the test case's expectations. Background test cases
+// can't be repeated.
+func (tc *TestCase) Repeat(n int) *TestCase {
+	tc.Repetitions = n
+	return tc
+}
+
+// expectsExitStatus reports whether err is an unsuccessful exit status that is
+// covered by the test case's exit code or signal expectations.
+func (tc *TestCase) expectsExitStatus(err error) bool {
+	var exitErr *osexec.ExitError
+	return errors.As(err, &exitErr) && (tc.Expectations.ExitCode != nil || tc.Expectations.Signal != nil)
+}
+
+// setProcessState records the exit code and resource usage of a process that
+// ran for the given duration.
+func (r *TestResult) setProcessState(state *os.ProcessState, duration time.Duration) {
+	r.ExitCode = state.ExitCode()
+	r.Duration = duration
+	if state != nil {
+		r.UserTime = state.UserTime()
+		r.SystemTime = state.SystemTime()
+		r.MaxRSS = maxRSS(state)
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			r.TerminatedBySignal = true
+			r.Signal = status.Signal()
+		}
+	}
+}
+
+func commandError(err error) error {
+	switch e := err.(type) {
+	case *fs.PathError:
+		return fmt.Errorf("%s: %s", e.Path, e.Err)
+	default:
+		return err
+	}
+}
+
+func (r *TestResult) setOutput(stdout, stderr string) {
+	tc := r.TestCase().(*TestCase)
+	r.Stdout, r.Stderr = stdout, stderr
+	if tc.StripANSI {
+		r.Stdout = stripANSI(r.Stdout)
+		r.Stderr = stripANSI(r.Stderr)
+	}
+
+	// values are captured before normalization, which may scrub them
+	r.capture(r.Stdout)
+
+	r.Stdout = r.normalize(r.Stdout)
+	r.Stderr = r.normalize(r.Stderr)
+}
+
+// run runs the command, enforcing the test case's timeout and carrying out
+// its dialogue, if any. When the timeout elapses, the command's process group
+// is sent SIGTERM, followed by SIGKILL if it has not exited by the end of the
+// grace period. If its output is still held open by a descendant outside the
+// process group a grace period after SIGKILL, run stops reading it and
+// returns.
+func (tc *TestCase) run(result *TestResult, stdout *outputBuffer) error {
+	timeout := tc.timeout()
+	if timeout <= 0 && len(tc.Dialogue) == 0 && tc.PTY == nil && len(tc.Signals) == 0 {
+		return tc.cmd.Run()
+	}
+
+	if len(tc.Dialogue) > 0 {
+		stdout.transcript = &transcript{}
+		defer func() {
+			result.Transcript = stdout.transcript.String()
+		}()
+	}
+
+	// with a dialogue, stdin is written by converse
+	input := tc.cmd.Stdin
+	var stdin io.WriteCloser
+	var terminal *os.File
+	var output, outputWriters []*os.File
+	var outputDone chan struct{}
+	if tc.PTY != nil {
+		master, slave, err := openPTY(tc.PTY.Rows, tc.PTY.Cols)
+		if err != nil {
+			return err
+		}
+
+		defer master.Close()
+		defer slave.Close()
+		terminal = slave
+
+		tc.cmd.Stdin, tc.cmd.Stdout, tc.cmd.Stderr = slave, slave, slave
+		setControllingTerminal(tc.cmd)
+
+		if len(tc.Dialogue) > 0 {
+			stdin = &ptyInput{master}
+		} else if input != nil {
+			go func() {
+				io.Copy(master, input)
+				(&ptyInput{master}).Close()
+			}()
+		}
+
+		// Reading from the master returns an error once the command and
+		// all of its children have closed the terminal.
+		outputDone = make(chan struct{})
+		go func() {
+			io.Copy(stdout, master)
+			close(outputDone)
+		}()
+
+		output = []*os.File{master}
+	} else {
+		if len(tc.Dialogue) > 0 {
+			tc.cmd.Stdin = nil
+			var err error
+			if stdin, err = tc.cmd.StdinPipe(); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if output, outputWriters, outputDone, err = pipeOutput(tc.cmd); err != nil {
+			return err
+		}
+
+		defer closeFiles(output)
+	}
+
+	setProcessGroup(tc.cmd)
+	err := tc.cmd.Start()
+
+	// the command has its own copies of the terminal and output pipes now
+	if terminal != nil {
+		terminal.Close()
+	}
+
+	closeFiles(outputWriters)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range tc.Signals {
+		signal := s.Signal
+		timer := time.AfterFunc(s.After, func() {
+			tc.cmd.Process.Signal(signal)
+		})
+		defer timer.Stop()
+	}
+
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		waitErr = tc.cmd.Wait()
+		if outputDone != nil {
+			<-outputDone
+		}
+
+		close(exited)
+	}()
+
+	var conversed chan error
+	if stdin != nil {
+		conversed = make(chan error, 1)
+		go func() {
+			conversed <- tc.converse(stdin, input, stdout, exited)
+		}()
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	kill := func() {
+		killProcessGroup(tc.cmd.Process)
+		select {
+		case <-exited:
+		case <-time.After(tc.gracePeriod()):
+			closeFiles(output)
+			<-exited
+		}
+	}
+
+	for {
+		select {
+		case <-exited:
+			if conversed != nil {
+				if err := <-conversed; err != nil {
+					result.errors = append(result.errors, fmt.Errorf("%w\ntranscript:\n%s", err, stdout.transcript))
+				}
+			}
+
+			return waitErr
+
+		case err := <-conversed:
+			conversed = nil
+			if err != nil {
+				result.errors = append(result.errors, fmt.Errorf("%w\ntranscript:\n%s", err, stdout.transcript))
+				kill()
+				return nil
+			}
+
+		case <-deadline:
+			result.TimedOut = true
+			terminateProcessGroup(tc.cmd.Process)
+			select {
+			case <-exited:
+			case <-time.After(tc.gracePeriod()):
+				kill()
+			}
+
+			return waitErr
+		}
+	}
+}
+
+// pipeOutput connects the command's stdout and stderr to pipes that are copied
+// to their original writers, so that waiting for the command doesn't also wait
+// for descendants that have inherited them. It returns the read ends of the
+// pipes, the write ends to close once the command has started, and a channel
+// that is closed when all of the output has been copied.
+func pipeOutput(cmd *osexec.Cmd) ([]*os.File, []*os.File, chan struct{}, error) {
+	writers := []*io.Writer{&cmd.Stdout, &cmd.Stderr}
+	var readEnds, writeEnds []*os.File
+	var wg sync.WaitGroup
+	for _, w := range writers {
+		r, pw, err := os.Pipe()
+		if err != nil {
+			closeFiles(readEnds)
+			closeFiles(writeEnds)
+			return nil, nil, nil, err
+		}
+
+		readEnds, writeEnds = append(readEnds, r), append(writeEnds, pw)
+		dst := *w
+		if dst == nil {
+			dst = io.Discard
+		}
+
+		*w = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(dst, r)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return readEnds, writeEnds, done, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func (tc *TestCase) timeout() time.Duration {
+	if tc.Timeout != 0 {
+		return tc.Timeout
+	}
+
+	return tc.tctx.Timeout
+}
+
+func (tc *TestCase) gracePeriod() time.Duration {
+	if tc.GracePeriod != 0 {
+		return tc.GracePeriod
+	}
+
+	if tc.tctx.GracePeriod != 0 {
+		return tc.tctx.GracePeriod
+	}
+
+	return defaultGracePeriod
+}
+
 func (tc *TestCase) Target() string {
-	return strings.Join(tc.cmd.Args, " ")
+	if tc.Pipeline != nil {
+		targets := make([]string, len(tc.Pipeline))
+		for i, stage := range tc.Pipeline {
+			targets[i] = stage.Target()
+		}
+
+		return strings.Join(targets, " | ")
+	}
+
+	if tc.Script != "" {
+		return tc.Script
+	}
+
+	if tc.spec == nil {
+		return ""
+	}
+
+	return strings.Join(tc.spec.Args, " ")
 }
 
 func (c *TestContext) newTestCase(cmd *osexec.Cmd, description ...string) *TestCase {
-	cmd.Env = append(c.Environment, cmd.Env...)
-	return &TestCase{
+	env := map[string]string{}
+	for _, kv := range cmd.Env {
+		k, v := splitEnvVar(kv)
+		env[k] = v
+	}
+
+	cmd.Env = nil
+	tc := &TestCase{
 		Desc:         strings.Join(description, ", "),
 		Expectations: Expectations{},
+		Environment:  env,
 
-		cmd:  cmd,
+		spec: cmd,
 		tctx: c,
 	}
+
+	if cmd.Stdin != nil {
+		tc.WithStdin(cmd.Stdin)
+	}
+
+	return tc
 }
 
 func Run(command string, description ...string) *TestCase {
@@ -115,8 +801,11 @@ func Cmd(command *osexec.Cmd, description ...string) *TestCase {
 	return DefaultContext().Cmd(command, description...)
 }
 
+// Run returns a test case that runs command. If the context has a Binary,
+// an empty command or the binary's name runs the binary instead. See
+// GoBinary.
 func (tc *TestContext) Run(command string, description ...string) *TestCase {
-	t := tc.newTestCase(osexec.Command(command), description...)
+	t := tc.newTestCase(osexec.Command(tc.command(command)), description...)
 	return t
 }
 
@@ -131,25 +820,57 @@ func (tc *TestCase) Describe(description string) *TestCase {
 }
 
 func (tc *TestCase) WithArgs(args ...string) *TestCase {
-	tc.cmd.Args = append(tc.cmd.Args, args...)
+	tc.spec.Args = append(tc.spec.Args, args...)
 	return tc
 }
 
 func (tc *TestCase) WithEnvVars(env map[string]string) *TestCase {
-	for k, v := range env {
-		tc.cmd.Env = append(tc.cmd.Env, k+"="+v)
-	}
+	tc.Environment, tc.UnsetEnvironment = setEnv(tc.Environment, tc.UnsetEnvironment, env)
+	return tc
+}
 
+// WithoutEnvVars removes the given variables from the command's environment,
+// including any set by its context.
+func (tc *TestCase) WithoutEnvVars(keys ...string) *TestCase {
+	tc.Environment, tc.UnsetEnvironment = unsetEnv(tc.Environment, tc.UnsetEnvironment, keys)
 	return tc
 }
 
+// WithStdin supplies the command's stdin. The reader is read in full when
+// the test case is first executed, and the input is reused by later runs and
+// by clones of the test case. An error reading it is reported when the test
+// case is executed. If the test case has a dialogue, the input is sent before
+// its first step.
 func (tc *TestCase) WithStdin(stdin io.Reader) *TestCase {
-	tc.cmd.Stdin = stdin
+	tc.spec.Stdin = nil
+	tc.stdin = nil
+	if stdin != nil {
+		tc.stdin = &stdinBuffer{reader: stdin}
+	}
+
 	return tc
 }
 
 func (tc *TestCase) WithWorkingDir(dir string) *TestCase {
-	tc.cmd.Dir = dir
+	tc.spec.Dir = dir
+	return tc
+}
+
+func (tc *TestCase) WithTimeout(timeout time.Duration) *TestCase {
+	tc.Timeout = timeout
+	return tc
+}
+
+func (tc *TestCase) WithGracePeriod(gracePeriod time.Duration) *TestCase {
+	tc.GracePeriod = gracePeriod
+	return tc
+}
+
+// SendSignalAfter sends a signal to the command's process once it has been
+// running for the given amount of time, for example to check that it shuts
+// down gracefully when interrupted.
+func (tc *TestCase) SendSignalAfter(signal os.Signal, after time.Duration) *TestCase {
+	tc.Signals = append(tc.Signals, ScheduledSignal{Signal: signal, After: after})
 	return tc
 }
 
@@ -158,6 +879,12 @@ func (tc *TestCase) ExpectExitCode(code int) *TestCase {
 	return tc
 }
 
+// ExpectSignal expects the command to be terminated by the given signal.
+func (tc *TestCase) ExpectSignal(signal syscall.Signal) *TestCase {
+	tc.Expectations.Signal = &signal
+	return tc
+}
+
 func (tc *TestCase) ExpectStdout(stdout string) *TestCase {
 	tc.Expectations.Stdout = &stdout
 	return tc
@@ -168,16 +895,209 @@ func (tc *TestCase) ExpectStderr(stderr string) *TestCase {
 	return tc
 }
 
+func (tc *TestCase) ExpectStdoutContains(substr string) *TestCase {
+	tc.Expectations.StdoutContains = append(tc.Expectations.StdoutContains, substr)
+	return tc
+}
+
+func (tc *TestCase) ExpectStdoutNotContains(substr string) *TestCase {
+	tc.Expectations.StdoutNotContains = append(tc.Expectations.StdoutNotContains, substr)
+	return tc
+}
+
+func (tc *TestCase) ExpectStdoutMatches(pattern *regexp.Regexp) *TestCase {
+	tc.Expectations.StdoutMatches = append(tc.Expectations.StdoutMatches, pattern)
+	return tc
+}
+
+func (tc *TestCase) ExpectStderrContains(substr string) *TestCase {
+	tc.Expectations.StderrContains = append(tc.Expectations.StderrContains, substr)
+	return tc
+}
+
+func (tc *TestCase) ExpectStderrNotContains(substr string) *TestCase {
+	tc.Expectations.StderrNotContains = append(tc.Expectations.StderrNotContains, substr)
+	return tc
+}
+
+func (tc *TestCase) ExpectStderrMatches(pattern *regexp.Regexp) *TestCase {
+	tc.Expectations.StderrMatches = append(tc.Expectations.StderrMatches, pattern)
+	return tc
+}
+
+func (tc *TestCase) ExpectStdoutJSON(expected interface{}) *TestCase {
+	tc.Expectations.StdoutJSON = expected
+	return tc
+}
+
+func (tc *TestCase) ExpectExactStdoutJSON(expected interface{}) *TestCase {
+	tc.Expectations.StdoutJSON = expected
+	tc.Expectations.WantExactStdoutJSON = true
+	return tc
+}
+
+func (tc *TestCase) ExpectStdoutGolden(path string) *TestCase {
+	tc.Expectations.StdoutGolden = path
+	return tc
+}
+
+func (tc *TestCase) ExpectStderrGolden(path string) *TestCase {
+	tc.Expectations.StderrGolden = path
+	return tc
+}
+
+// ExpectTimeout expects the command to still be running when its timeout
+// elapses. A timeout must be set on the test case or its context; without
+// one the command can't time out, so the expectation fails.
+func (tc *TestCase) ExpectTimeout() *TestCase {
+	tc.Expectations.TimedOut = true
+	return tc
+}
+
+// ExpectDurationUnder expects the command's wall time to be less than d.
+func (tc *TestCase) ExpectDurationUnder(d time.Duration) *TestCase {
+	tc.Expectations.MaxDuration = d
+	return tc
+}
+
+// ExpectCPUTimeUnder expects the command's combined user and system CPU time
+// to be less than d.
+func (tc *TestCase) ExpectCPUTimeUnder(d time.Duration) *TestCase {
+	tc.Expectations.MaxCPUTime = d
+	return tc
+}
+
+// ExpectMaxRSSUnder expects the command's maximum resident set size to be
+// less than the given number of bytes. It is only supported on Linux.
+func (tc *TestCase) ExpectMaxRSSUnder(bytes int64) *TestCase {
+	tc.Expectations.MaxRSS = bytes
+	return tc
+}
+
+func (e Expectations) clone() Expectations {
+	e.StdoutContains = append([]string(nil), e.StdoutContains...)
+	e.StdoutNotContains = append([]string(nil), e.StdoutNotContains...)
+	e.StdoutMatches = append([]*regexp.Regexp(nil), e.StdoutMatches...)
+	e.StderrContains = append([]string(nil), e.StderrContains...)
+	e.StderrNotContains = append([]string(nil), e.StderrNotContains...)
+	e.StderrMatches = append([]*regexp.Regexp(nil), e.StderrMatches...)
+	if e.StdoutLines != nil {
+		e.StdoutLines = append([]string{}, e.StdoutLines...)
+	}
+
+	if e.StderrLines != nil {
+		e.StderrLines = append([]string{}, e.StderrLines...)
+	}
+
+	e.StdoutJSONLines = append([]interface{}(nil), e.StdoutJSONLines...)
+	e.StderrJSONLines = append([]interface{}(nil), e.StderrJSONLines...)
+
+	files := e.Files
+	e.Files = nil
+	for _, f := range files {
+		c := *f
+		c.Contains = append([]string(nil), f.Contains...)
+		c.NotContains = append([]string(nil), f.NotContains...)
+		c.Matches = append([]*regexp.Regexp(nil), f.Matches...)
+		e.Files = append(e.Files, &c)
+	}
+
+	e.Stubs = append([]*StubExpectation(nil), e.Stubs...)
+	e.HTTPRequests = append([]*HTTPRequestExpectation(nil), e.HTTPRequests...)
+
+	return e
+}
+
 type Expectations struct {
 	ExitCode *int
+	Signal   *syscall.Signal
 	Stdout   *string
 	Stderr   *string
+
+	StdoutContains    []string
+	StdoutNotContains []string
+	StdoutMatches     []*regexp.Regexp
+	StderrContains    []string
+	StderrNotContains []string
+	StderrMatches     []*regexp.Regexp
+
+	StdoutJSON          interface{}
+	WantExactStdoutJSON bool
+
+	StdoutLines              []string
+	WantUnorderedStdoutLines bool
+	StderrLines              []string
+	WantUnorderedStderrLines bool
+	StdoutLineCount          *int
+	StderrLineCount          *int
+	StdoutJSONLines          []interface{}
+	StderrJSONLines          []interface{}
+
+	StdoutGolden string
+	StderrGolden string
+
+	TimedOut bool
+
+	Files []*FileExpectation
+	Stubs []*StubExpectation
+
+	HTTPRequests []*HTTPRequestExpectation
+
+	MaxDuration time.Duration
+	MaxCPUTime  time.Duration
+	MaxRSS      int64
 }
 
 type TestResult struct {
 	ExitCode int
 	Stdout   string
 	Stderr   string
+	TimedOut bool
+
+	// Duration is the wall time the command ran for. UserTime and SystemTime
+	// are the CPU time it consumed, and MaxRSS is its maximum resident set
+	// size in bytes, which is only reported on Linux.
+	Duration   time.Duration
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64
+
+	// TerminatedBySignal is true if the command was killed by a signal, in
+	// which case Signal is the signal and ExitCode is -1.
+	TerminatedBySignal bool
+	Signal             syscall.Signal
+
+	// Transcript records the stdout and stdin exchanged during an interactive
+	// session. It is empty for test cases without a dialogue.
+	Transcript string
+
+	// SandboxDir is the root of the sandbox the command ran in, if any. The
+	// command's working directory is its "work" subdirectory.
+	SandboxDir string
+
+	// StubCalls holds the invocations of the command's stubs, in the order
+	// they started.
+	StubCalls []StubCall
+
+	// HTTPRequests holds the requests received by the command's HTTP stubs,
+	// in the order they arrived.
+	HTTPRequests []HTTPRequest
+
+	// CoverDir is the GOCOVERDIR the command wrote its coverage data to, if
+	// its context is collecting coverage.
+	CoverDir string
+
+	// Stages holds the result of each command in a pipeline. The pipeline's
+	// own ExitCode and Stdout are those of its last stage, and its Stderr is
+	// the stderr of every stage combined.
+	Stages []*TestResult
+
+	// Runs holds the result of each run of a repeated test case. The other
+	// fields hold the result of the last run.
+	Runs []*TestResult
+
+	// Environment is the environment the command ran with, sorted by name.
+	Environment []string
 
 	errors   []error
 	testCase *TestCase
@@ -195,16 +1115,123 @@ func (r *TestResult) TestCase() mt.TestCase {
 
 func (r *TestResult) validateExpectations() {
 	tc := r.TestCase().(*TestCase)
+	e := tc.expectations()
 
-	if tc.Expectations.ExitCode != nil && r.ExitCode != *tc.Expectations.ExitCode {
-		r.errors = append(r.errors, fmt.Errorf("expected exit code %d, got %d", *tc.Expectations.ExitCode, r.ExitCode))
+	if r.TimedOut && !e.TimedOut {
+		r.errors = append(r.errors, fmt.Errorf("command timed out after %s", tc.timeout()))
+	} else if !r.TimedOut && e.TimedOut {
+		r.errors = append(r.errors, fmt.Errorf("expected command to time out, but it exited with code %d", r.ExitCode))
 	}
 
-	if tc.Expectations.Stdout != nil && r.Stdout != *tc.Expectations.Stdout {
-		r.errors = append(r.errors, fmt.Errorf("expected stdout %q, got %q", *tc.Expectations.Stdout, r.Stdout))
+	if e.ExitCode != nil && r.ExitCode != *e.ExitCode {
+		if r.TerminatedBySignal {
+			r.errors = append(r.errors, fmt.Errorf("expected exit code %d, but command was terminated by signal %d (%s)", *e.ExitCode, r.Signal, r.Signal))
+		} else {
+			r.errors = append(r.errors, fmt.Errorf("expected exit code %d, got %d", *e.ExitCode, r.ExitCode))
+		}
 	}
 
-	if tc.Expectations.Stderr != nil && r.Stderr != *tc.Expectations.Stderr {
-		r.errors = append(r.errors, fmt.Errorf("expected stderr %q, got %q", *tc.Expectations.Stderr, r.Stderr))
+	if e.Signal != nil {
+		if !r.TerminatedBySignal {
+			r.errors = append(r.errors, fmt.Errorf("expected command to be terminated by signal %d (%s), but it exited with code %d", *e.Signal, *e.Signal, r.ExitCode))
+		} else if r.Signal != *e.Signal {
+			r.errors = append(r.errors, fmt.Errorf("expected command to be terminated by signal %d (%s), got signal %d (%s)", *e.Signal, *e.Signal, r.Signal, r.Signal))
+		}
+	}
+
+	if e.Stdout != nil && r.Stdout != *e.Stdout {
+		r.errors = append(r.errors, tc.diffConfig().mismatch("stdout", *e.Stdout, r.Stdout))
+	}
+
+	if e.Stderr != nil && r.Stderr != *e.Stderr {
+		r.errors = append(r.errors, tc.diffConfig().mismatch("stderr", *e.Stderr, r.Stderr))
+	}
+
+	r.validateStream("stdout", r.Stdout, e.StdoutContains, e.StdoutNotContains, e.StdoutMatches)
+	r.validateStream("stderr", r.Stderr, e.StderrContains, e.StderrNotContains, e.StderrMatches)
+
+	if e.StdoutJSON != nil {
+		r.validateJSON("stdout", r.Stdout, e.StdoutJSON, e.WantExactStdoutJSON)
+	}
+
+	r.validateLines("stdout", r.Stdout, e.StdoutLines, e.WantUnorderedStdoutLines, tc.diffConfig())
+	r.validateLines("stderr", r.Stderr, e.StderrLines, e.WantUnorderedStderrLines, tc.diffConfig())
+	r.validateLineCount("stdout", r.Stdout, e.StdoutLineCount)
+	r.validateLineCount("stderr", r.Stderr, e.StderrLineCount)
+	for _, expected := range e.StdoutJSONLines {
+		r.validateJSONLine("stdout", r.Stdout, expected)
+	}
+
+	for _, expected := range e.StderrJSONLines {
+		r.validateJSONLine("stderr", r.Stderr, expected)
+	}
+
+	if e.StdoutGolden != "" {
+		if err := validateGolden("stdout", e.StdoutGolden, r.Stdout, tc.diffConfig()); err != nil {
+			r.errors = append(r.errors, err)
+		}
+	}
+
+	if e.StderrGolden != "" {
+		if err := validateGolden("stderr", e.StderrGolden, r.Stderr, tc.diffConfig()); err != nil {
+			r.errors = append(r.errors, err)
+		}
+	}
+
+	for _, f := range e.Files {
+		r.validateFile(f, tc.cmd.Dir, tc.diffConfig())
+	}
+
+	for _, stub := range e.Stubs {
+		r.validateStub(stub)
+	}
+
+	for _, req := range e.HTTPRequests {
+		r.validateHTTPRequest(req)
+	}
+
+	if e.MaxDuration > 0 && r.Duration >= e.MaxDuration {
+		r.errors = append(r.errors, fmt.Errorf("expected command to run for less than %s, took %s", e.MaxDuration, r.Duration))
+	}
+
+	if cpu := r.UserTime + r.SystemTime; e.MaxCPUTime > 0 && cpu >= e.MaxCPUTime {
+		r.errors = append(r.errors, fmt.Errorf("expected command to use less than %s of CPU time, used %s (user %s, system %s)", e.MaxCPUTime, cpu, r.UserTime, r.SystemTime))
+	}
+
+	if e.MaxRSS > 0 {
+		if r.MaxRSS == 0 {
+			r.errors = append(r.errors, fmt.Errorf("expected max RSS under %d bytes, but max RSS is not available on this platform", e.MaxRSS))
+		} else if r.MaxRSS >= e.MaxRSS {
+			r.errors = append(r.errors, fmt.Errorf("expected max RSS under %d bytes, got %d", e.MaxRSS, r.MaxRSS))
+		}
+	}
+}
+
+func (r *TestResult) validateJSON(name, output string, expected interface{}, exact bool) {
+	var actual interface{}
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		r.errors = append(r.errors, fmt.Errorf("expected %s to be JSON: %w, got %q", name, err, output))
+	} else if errs := expect.Value(name, expected, actual, exact); len(errs) > 0 {
+		r.errors = append(r.errors, errs...)
+	}
+}
+
+func (r *TestResult) validateStream(name, output string, contains, notContains []string, matches []*regexp.Regexp) {
+	for _, substr := range contains {
+		if !strings.Contains(output, substr) {
+			r.errors = append(r.errors, fmt.Errorf("expected %s to contain %q, got %q", name, substr, output))
+		}
+	}
+
+	for _, substr := range notContains {
+		if strings.Contains(output, substr) {
+			r.errors = append(r.errors, fmt.Errorf("expected %s not to contain %q, got %q", name, substr, output))
+		}
+	}
+
+	for _, pattern := range matches {
+		if !pattern.MatchString(output) {
+			r.errors = append(r.errors, fmt.Errorf("expected %s to match /%s/, got %q", name, pattern, output))
+		}
 	}
 }
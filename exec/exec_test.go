@@ -0,0 +1,350 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	mtjson "github.com/jefflinse/melatonin/json"
+)
+
+func TestExpectations(t *testing.T) {
+	echo := func(args ...string) *TestCase {
+		return Run("echo").WithArgs(args...)
+	}
+
+	tests := []struct {
+		name     string
+		requires string // a program the case needs on PATH, if any
+		pass     *TestCase
+		fail     *TestCase
+		want     []string // substrings of the failure message
+	}{
+		{
+			name: "exit code",
+			pass: Run("false").ExpectExitCode(1),
+			fail: Run("false").ExpectExitCode(0),
+			want: []string{"expected exit code 0, got 1"},
+		},
+		{
+			name: "unsuccessful exit",
+			pass: Run("true"),
+			fail: Run("false"),
+			want: []string{"exit status 1"},
+		},
+		{
+			name: "stdout contains",
+			pass: echo("hello").ExpectStdoutContains("ell"),
+			fail: echo("hello").ExpectStdoutContains("goodbye"),
+			want: []string{`stdout to contain "goodbye"`, `"hello\n"`},
+		},
+		{
+			name: "stdout not contains",
+			pass: echo("hello").ExpectStdoutNotContains("goodbye"),
+			fail: echo("hello").ExpectStdoutNotContains("ell"),
+			want: []string{`stdout not to contain "ell"`, `"hello\n"`},
+		},
+		{
+			name: "stdout matches",
+			pass: echo("hello").ExpectStdoutMatches(regexp.MustCompile(`^h\w+`)),
+			fail: echo("hello").ExpectStdoutMatches(regexp.MustCompile(`^bye`)),
+			want: []string{"stdout to match /^bye/", `"hello\n"`},
+		},
+		{
+			name: "stderr contains",
+			pass: Run("sh").WithArgs("-c", "echo hello >&2").ExpectStderrContains("ell"),
+			fail: Run("sh").WithArgs("-c", "echo hello >&2").ExpectStderrContains("goodbye"),
+			want: []string{`stderr to contain "goodbye"`, `"hello\n"`},
+		},
+		{
+			name: "stderr not contains",
+			pass: Run("sh").WithArgs("-c", "echo hello >&2").ExpectStderrNotContains("goodbye"),
+			fail: Run("sh").WithArgs("-c", "echo hello >&2").ExpectStderrNotContains("ell"),
+			want: []string{`stderr not to contain "ell"`, `"hello\n"`},
+		},
+		{
+			name: "stderr matches",
+			pass: Run("sh").WithArgs("-c", "echo hello >&2").ExpectStderrMatches(regexp.MustCompile(`^h\w+`)),
+			fail: Run("sh").WithArgs("-c", "echo hello >&2").ExpectStderrMatches(regexp.MustCompile(`^bye`)),
+			want: []string{"stderr to match /^bye/", `"hello\n"`},
+		},
+		{
+			name: "stdout JSON",
+			pass: echo(`{"a": 1, "b": 2}`).ExpectStdoutJSON(mtjson.Object{"a": 1}),
+			fail: echo(`{"a": 1, "b": 2}`).ExpectStdoutJSON(mtjson.Object{"a": 2}),
+			want: []string{`stdout.a: expected "2", got "1"`},
+		},
+		{
+			name: "stdout not JSON",
+			pass: echo(`{"a": 1}`).ExpectStdoutJSON(mtjson.Object{"a": 1}),
+			fail: echo("hello").ExpectStdoutJSON(mtjson.Object{"a": 1}),
+			want: []string{"expected stdout to be JSON", `"hello\n"`},
+		},
+		{
+			name: "timeout",
+			pass: Run("sleep").WithArgs("5").WithTimeout(100 * time.Millisecond).ExpectTimeout(),
+			fail: Run("true").ExpectTimeout(),
+			want: []string{"expected command to time out"},
+		},
+		{
+			name: "file",
+			pass: Run("touch").WithArgs("made.txt").WithSandbox("").ExpectFile("made.txt"),
+			fail: Run("true").WithSandbox("").ExpectFile("missing.txt"),
+			want: []string{"expected file missing.txt to exist"},
+		},
+		{
+			name: "no file",
+			pass: Run("true").WithSandbox("").ExpectNoFile("made.txt"),
+			fail: Run("touch").WithArgs("made.txt").WithSandbox("").ExpectNoFile("made.txt"),
+			want: []string{"expected file made.txt not to exist"},
+		},
+		{
+			name: "no file with contents",
+			pass: Run("true").WithSandbox("").ExpectNoFile("f.txt"),
+			fail: Run("true").WithSandbox("").ExpectNoFile("f.txt").ExpectFileContains("f.txt", "hello"),
+			want: []string{"file f.txt: expected not to exist, but has expectations about its contents"},
+		},
+		{
+			name: "file contents",
+			pass: Run("sh").WithArgs("-c", "echo hello > f.txt").WithSandbox("").ExpectFileContents("f.txt", "hello\n"),
+			fail: Run("sh").WithArgs("-c", "echo hello > f.txt").WithSandbox("").ExpectFileContents("f.txt", "goodbye\n"),
+			want: []string{`"goodbye\n"`, `"hello\n"`},
+		},
+		{
+			name: "signal",
+			pass: Run("sh").WithArgs("-c", "kill -TERM $$").ExpectSignal(syscall.SIGTERM),
+			fail: Run("true").ExpectSignal(syscall.SIGTERM),
+			want: []string{"signal 15", "exited with code 0"},
+		},
+		{
+			name: "stub called",
+			pass: Run("sh").WithArgs("-c", "git status").WithStub("git", StubResponse{}).ExpectStubCalled("git"),
+			fail: Run("true").WithStub("git", StubResponse{}).ExpectStubCalled("git"),
+			want: []string{"expected stub git to be called"},
+		},
+		{
+			name: "stub called with",
+			pass: Run("sh").WithArgs("-c", "git status").WithStub("git", StubResponse{}).ExpectStubCalledWith("git", "status"),
+			fail: Run("sh").WithArgs("-c", "git status").WithStub("git", StubResponse{}).ExpectStubCalledWith("git", "log"),
+			want: []string{`called with args ["log"]`, `["status"]`},
+		},
+		{
+			name: "stub called without args",
+			pass: Run("sh").WithArgs("-c", "git").WithStub("git", StubResponse{}).ExpectStubCalledWith("git"),
+			fail: Run("sh").WithArgs("-c", "git status").WithStub("git", StubResponse{}).ExpectStubCalledWith("git"),
+			want: []string{`called with args []`, `["status"]`},
+		},
+		{
+			name: "stub not called",
+			pass: Run("true").WithStub("git", StubResponse{}).ExpectStubNotCalled("git"),
+			fail: Run("sh").WithArgs("-c", "git status").WithStub("git", StubResponse{}).ExpectStubNotCalled("git"),
+			want: []string{"expected stub git not to be called", `["status"]`},
+		},
+		{
+			name:     "HTTP request",
+			requires: "curl",
+			pass: Run("sh").WithArgs("-c", `curl -s "$API_URL/"`).
+				WithHTTPStub("API_URL", HTTPRoute{Method: "GET", Path: "/", Status: 200}).
+				ExpectHTTPRequest("GET", "/", ""),
+			fail: Run("true").
+				WithHTTPStub("API_URL", HTTPRoute{Method: "GET", Path: "/", Status: 200}).
+				ExpectHTTPRequest("GET", "/", ""),
+			want: []string{"expected HTTP request GET /"},
+		},
+		{
+			name: "shell",
+			pass: Shell("echo hello | tr a-z A-Z >&2").ExpectStderrContains("HELLO"),
+			fail: Shell("echo hello | tr a-z A-Z >&2").ExpectStderrContains("hello"),
+			want: []string{`stderr to contain "hello"`, `"HELLO\n"`},
+		},
+		{
+			name: "capture",
+			pass: NewTestContext().Run("echo").WithArgs("id=42").CaptureStdout("id", regexp.MustCompile(`id=(\w+)`)),
+			fail: NewTestContext().Run("echo").WithArgs("hello").CaptureStdout("id", regexp.MustCompile(`id=(\w+)`)),
+			want: []string{`capture id: expected stdout to match /id=(\w+)/`, `"hello\n"`},
+		},
+		{
+			name: "ordered lines",
+			pass: Run("printf").WithArgs(`a\nb\n`).ExpectStdoutLines("a", "b"),
+			fail: Run("printf").WithArgs(`a\nb\n`).ExpectStdoutLines("b", "a"),
+			want: []string{"stdout lines does not match", "-b\n a\n+b\n"},
+		},
+		{
+			name: "unordered lines missing",
+			pass: Run("printf").WithArgs(`a\nb\na\n`).ExpectStdoutLinesUnordered("b", "a", "a"),
+			fail: Run("printf").WithArgs(`a\nb\n`).ExpectStdoutLinesUnordered("b", "a", "a"),
+			want: []string{`stdout to contain lines ["a"]`, `got ["a" "b"]`},
+		},
+		{
+			name: "unordered lines unexpected",
+			pass: Run("printf").WithArgs(`a\nb\n`).ExpectStdoutLinesUnordered("b", "a"),
+			fail: Run("printf").WithArgs(`a\nb\nc\n`).ExpectStdoutLinesUnordered("b", "a"),
+			want: []string{`stdout not to contain lines ["c"]`, `got ["a" "b" "c"]`},
+		},
+		{
+			name: "line count",
+			pass: Run("printf").WithArgs(`a\nb\n`).ExpectLineCount(2),
+			fail: Run("printf").WithArgs(`a\nb\n`).ExpectLineCount(3),
+			want: []string{"stdout to have 3 lines, got 2"},
+		},
+		{
+			name: "JSON line",
+			pass: Shell(`echo '{"level": "info"}' >&2`).ExpectStderrJSONLine(mtjson.Object{"level": "info"}),
+			fail: Shell(`echo '{"level": "info"}' >&2`).ExpectStderrJSONLine(mtjson.Object{"level": "error"}),
+			want: []string{`JSON line matching {"level":"error"}`, `"{\"level\": \"info\"}\n"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.requires != "" {
+				if _, err := osexec.LookPath(tt.requires); err != nil {
+					t.Skipf("%s not found on PATH", tt.requires)
+				}
+			}
+
+			result, err := tt.pass.Execute(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if errs := result.Errors(); len(errs) > 0 {
+				t.Errorf("expected passing case to have no errors, got %v", errs)
+			}
+
+			result, err = tt.fail.Execute(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs := result.Errors()
+			if len(errs) == 0 {
+				t.Fatal("expected failing case to have errors, got none")
+			}
+
+			msg := fmt.Sprint(errs)
+			for _, want := range tt.want {
+				if !strings.Contains(msg, want) {
+					t.Errorf("expected errors to contain %q, got %s", want, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeoutWithDetachedDescendant(t *testing.T) {
+	if _, err := osexec.LookPath("setsid"); err != nil {
+		t.Skip("setsid not found on PATH")
+	}
+
+	// the descendant leaves the process group but keeps stdout and stderr open
+	tc := Run("sh").WithArgs("-c", "setsid sleep 5 & sleep 30").
+		WithTimeout(200 * time.Millisecond).
+		WithGracePeriod(100 * time.Millisecond).
+		ExpectTimeout()
+
+	started := time.Now()
+	result, err := tc.Execute(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errs := result.Errors(); len(errs) > 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("expected Execute to return after the timeout, took %s", elapsed)
+	}
+}
+
+func TestStartNotReady(t *testing.T) {
+	tc := Start("true").WithSandbox("").ReadyWhenOutputMatches(regexp.MustCompile("ready"))
+	for i := 0; i < 2; i++ {
+		result, err := tc.Execute(t)
+		if err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+
+		if errs := result.Errors(); len(errs) == 0 {
+			t.Errorf("run %d: expected a readiness error, got none", i+1)
+		}
+
+		if _, err := os.Stat(result.(*TestResult).SandboxDir); !os.IsNotExist(err) {
+			t.Errorf("run %d: expected sandbox to be removed, got %v", i+1, err)
+		}
+	}
+}
+
+func TestDialogueWithStdin(t *testing.T) {
+	tc := Run("sh").WithArgs("-c", `read a; echo "a=$a"; read b; echo "b=$b"`).
+		WithStdin(strings.NewReader("one\n")).
+		WaitFor(regexp.MustCompile(`a=one`)).
+		SendLine("two").
+		ExpectStdoutContains("b=two")
+
+	result, err := tc.Execute(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errs := result.Errors(); len(errs) > 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestStartRejectsUnsupportedOptions(t *testing.T) {
+	for _, tc := range []*TestCase{
+		Start("cat").WithTimeout(time.Second),
+		Start("cat").SendSignalAfter(syscall.SIGTERM, time.Second),
+		Start("cat").SendLine("hello"),
+		Start("cat").WithPTY(24, 80),
+		Start("cat").Repeat(3),
+	} {
+		if _, err := tc.Execute(t); err == nil {
+			t.Errorf("%s: expected an error", tc.Description())
+		}
+	}
+}
+
+func TestKillBackground(t *testing.T) {
+	tc := Start("sleep").WithArgs("30")
+	if _, err := tc.Execute(t); err != nil {
+		t.Fatal(err)
+	}
+
+	KillBackground()
+	if tc.process.running() {
+		t.Error("expected the background process to be killed")
+	}
+}
+
+func TestStdinReadOnFirstRun(t *testing.T) {
+	r, w := io.Pipe()
+
+	// building the test case mustn't read from the pipe, which isn't fed
+	// until afterwards
+	tc := Run("cat").WithStdin(r).ExpectStdout("hello\n")
+	clone := tc.Clone()
+	go func() {
+		io.WriteString(w, "hello\n")
+		w.Close()
+	}()
+
+	for i, tc := range []*TestCase{tc, tc, clone} {
+		result, err := tc.Execute(t)
+		if err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+
+		if errs := result.Errors(); len(errs) > 0 {
+			t.Errorf("run %d: expected no errors, got %v", i+1, errs)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// A FileExpectation describes the expected state of a file after a command
+// exits. Relative paths are resolved against the command's working directory.
+type FileExpectation struct {
+	Path          string
+	Exists        bool
+	Contents      *string
+	Contains      []string
+	NotContains   []string
+	Matches       []*regexp.Regexp
+	JSON          interface{}
+	WantExactJSON bool
+	Mode          *fs.FileMode
+	SymlinkTarget *string
+}
+
+// ExpectFile expects the file at path to exist.
+func (tc *TestCase) ExpectFile(path string) *TestCase {
+	tc.fileExpectation(path).Exists = true
+	return tc
+}
+
+// ExpectNoFile expects the file at path not to exist. Combining it with any
+// other expectation on the same file is reported as an error.
+func (tc *TestCase) ExpectNoFile(path string) *TestCase {
+	tc.fileExpectation(path).Exists = false
+	return tc
+}
+
+func (tc *TestCase) ExpectFileContents(path string, contents string) *TestCase {
+	tc.fileExpectation(path).Contents = &contents
+	return tc
+}
+
+func (tc *TestCase) ExpectFileContains(path string, substr string) *TestCase {
+	f := tc.fileExpectation(path)
+	f.Contains = append(f.Contains, substr)
+	return tc
+}
+
+func (tc *TestCase) ExpectFileNotContains(path string, substr string) *TestCase {
+	f := tc.fileExpectation(path)
+	f.NotContains = append(f.NotContains, substr)
+	return tc
+}
+
+func (tc *TestCase) ExpectFileMatches(path string, pattern *regexp.Regexp) *TestCase {
+	f := tc.fileExpectation(path)
+	f.Matches = append(f.Matches, pattern)
+	return tc
+}
+
+func (tc *TestCase) ExpectFileJSON(path string, expected interface{}) *TestCase {
+	tc.fileExpectation(path).JSON = expected
+	return tc
+}
+
+func (tc *TestCase) ExpectExactFileJSON(path string, expected interface{}) *TestCase {
+	f := tc.fileExpectation(path)
+	f.JSON = expected
+	f.WantExactJSON = true
+	return tc
+}
+
+// ExpectFileMode expects the file at path to have the given mode, including
+// its type bits; for example, 0644 for a regular file or fs.ModeDir|0755 for
+// a directory.
+func (tc *TestCase) ExpectFileMode(path string, mode fs.FileMode) *TestCase {
+	tc.fileExpectation(path).Mode = &mode
+	return tc
+}
+
+// ExpectSymlink expects the file at path to be a symbolic link to target.
+func (tc *TestCase) ExpectSymlink(path string, target string) *TestCase {
+	tc.fileExpectation(path).SymlinkTarget = &target
+	return tc
+}
+
+// fileExpectation returns the expectation for the file at path, adding one
+// that expects the file to exist if there isn't one already.
+func (tc *TestCase) fileExpectation(path string) *FileExpectation {
+	for _, f := range tc.Expectations.Files {
+		if f.Path == path {
+			return f
+		}
+	}
+
+	f := &FileExpectation{Path: path, Exists: true}
+	tc.Expectations.Files = append(tc.Expectations.Files, f)
+	return f
+}
+
+// describesContents reports whether the expectation checks anything about
+// the file besides whether it exists.
+func (f *FileExpectation) describesContents() bool {
+	return f.Contents != nil || len(f.Contains) > 0 || len(f.NotContains) > 0 || len(f.Matches) > 0 ||
+		f.JSON != nil || f.Mode != nil || f.SymlinkTarget != nil
+}
+
+func (r *TestResult) validateFile(f *FileExpectation, dir string, cfg DiffConfig) {
+	if !f.Exists && f.describesContents() {
+		r.errors = append(r.errors, fmt.Errorf("file %s: expected not to exist, but has expectations about its contents", f.Path))
+		return
+	}
+
+	path := f.Path
+	if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			r.errors = append(r.errors, fmt.Errorf("file %s: %w", f.Path, err))
+		} else if f.Exists {
+			r.errors = append(r.errors, fmt.Errorf("expected file %s to exist", f.Path))
+		}
+
+		return
+	}
+
+	if !f.Exists {
+		r.errors = append(r.errors, fmt.Errorf("expected file %s not to exist", f.Path))
+		return
+	}
+
+	if f.SymlinkTarget != nil {
+		if info.Mode()&fs.ModeSymlink == 0 {
+			r.errors = append(r.errors, fmt.Errorf("expected file %s to be a symlink, got mode %s", f.Path, info.Mode()))
+		} else if target, err := os.Readlink(path); err != nil {
+			r.errors = append(r.errors, fmt.Errorf("file %s: %w", f.Path, err))
+		} else if target != *f.SymlinkTarget {
+			r.errors = append(r.errors, fmt.Errorf("expected file %s to link to %q, got %q", f.Path, *f.SymlinkTarget, target))
+		}
+	}
+
+	if f.Mode != nil {
+		if info, err = os.Stat(path); err != nil {
+			r.errors = append(r.errors, fmt.Errorf("file %s: %w", f.Path, err))
+		} else if info.Mode() != *f.Mode {
+			r.errors = append(r.errors, fmt.Errorf("expected file %s to have mode %s, got %s", f.Path, *f.Mode, info.Mode()))
+		}
+	}
+
+	if f.Contents == nil && len(f.Contains) == 0 && len(f.NotContains) == 0 && len(f.Matches) == 0 && f.JSON == nil {
+		return
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		r.errors = append(r.errors, fmt.Errorf("file %s: %w", f.Path, err))
+		return
+	}
+
+	name := "file " + f.Path
+	if f.Contents != nil && string(b) != *f.Contents {
+		r.errors = append(r.errors, cfg.mismatch(name, *f.Contents, string(b)))
+	}
+
+	r.validateStream(name, string(b), f.Contains, f.NotContains, f.Matches)
+
+	if f.JSON != nil {
+		r.validateJSON(name, string(b), f.JSON, f.WantExactJSON)
+	}
+}
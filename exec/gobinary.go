@@ -0,0 +1,218 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GoBuildOptions configures how GoBinary builds a package.
+type GoBuildOptions struct {
+	// Dir is the directory go build is run in, which determines the module
+	// that pkgPath is resolved against. The default is the current
+	// directory.
+	Dir string
+
+	// Race enables the race detector.
+	Race bool
+
+	// LDFlags are passed to the linker, for example to set version
+	// variables with -X.
+	LDFlags string
+
+	// Tags are the build tags to use.
+	Tags []string
+
+	// Cover builds the binary with coverage instrumentation (Go 1.20 or
+	// later), and the returned context collects its coverage data. See
+	// TestContext.WithCoverage.
+	Cover bool
+
+	// CoverPkg lists the packages instrumented for coverage, as patterns
+	// accepted by go build -coverpkg. The default is the main module's
+	// packages that are dependencies of pkgPath.
+	CoverPkg []string
+}
+
+// goBinaries caches the binaries built by GoBinary for the lifetime of the
+// process.
+var goBinaries = struct {
+	sync.Mutex
+	dir    string
+	builds map[string]*goBuild
+}{
+	builds: map[string]*goBuild{},
+}
+
+type goBuild struct {
+	once sync.Once
+	out  string
+	path string
+	err  error
+}
+
+// GoBinary builds the Go package at pkgPath, which may be an import path or
+// a relative path such as "./cmd/mytool", and returns a new context whose Run
+// targets the built binary: Run("") or Run with the binary's name (the last
+// element of pkgPath, such as "mytool") runs it, while other commands run as
+// usual. Test scripts loaded from the context can run it by name too.
+//
+// Each package is built at most once per process for a given set of
+// options; subsequent calls reuse the binary, and go build's own cache keeps
+// rebuilds fast. Binaries are written to a temporary directory, which is
+// removed by CleanUpGoBinaries.
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		exec.CleanUpGoBinaries()
+//		os.Exit(code)
+//	}
+//
+//	func TestCLI(t *testing.T) {
+//		cli, err := exec.GoBinary("./cmd/mytool", exec.GoBuildOptions{Race: true})
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//
+//		mt.RunTestsT(t, []mt.TestCase{
+//			cli.Run("mytool").WithArgs("version").ExpectExitCode(0),
+//		})
+//	}
+func GoBinary(pkgPath string, opts GoBuildOptions) (*TestContext, error) {
+	bin, err := buildGoBinary(pkgPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewTestContext()
+	c.Binary = bin
+	if opts.Cover {
+		goBinaries.Lock()
+		dir, err := os.MkdirTemp(goBinaries.dir, "cover-")
+		goBinaries.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("create coverage directory: %w", err)
+		}
+
+		c.CoverDir = dir
+	}
+
+	return c, nil
+}
+
+// command returns the program that Run runs for command: the context's
+// Binary, if command is empty or the binary's name, or otherwise command.
+func (c *TestContext) command(command string) string {
+	if c.Binary == "" {
+		return command
+	}
+
+	if command == "" || command == strings.TrimSuffix(filepath.Base(c.Binary), ".exe") {
+		return c.Binary
+	}
+
+	return command
+}
+
+// CleanUpGoBinaries removes the binaries built by GoBinary. Contexts returned
+// by GoBinary can't be used afterwards, but calling GoBinary again rebuilds
+// the binary.
+func CleanUpGoBinaries() error {
+	goBinaries.Lock()
+	defer goBinaries.Unlock()
+
+	dir := goBinaries.dir
+	goBinaries.dir = ""
+	goBinaries.builds = map[string]*goBuild{}
+	if dir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func buildGoBinary(pkgPath string, opts GoBuildOptions) (string, error) {
+	args := []string{"build"}
+	if opts.Race {
+		args = append(args, "-race")
+	}
+
+	if opts.LDFlags != "" {
+		args = append(args, "-ldflags", opts.LDFlags)
+	}
+
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(opts.Tags, ","))
+	}
+
+	if opts.Cover {
+		args = append(args, "-cover")
+		if len(opts.CoverPkg) > 0 {
+			args = append(args, "-coverpkg", strings.Join(opts.CoverPkg, ","))
+		}
+	}
+
+	key := strings.Join(append([]string{opts.Dir, pkgPath}, args...), "\x00")
+
+	goBinaries.Lock()
+	if goBinaries.dir == "" {
+		dir, err := os.MkdirTemp("", "melatonin-go-")
+		if err != nil {
+			goBinaries.Unlock()
+			return "", fmt.Errorf("build %s: %w", pkgPath, err)
+		}
+
+		goBinaries.dir = dir
+	}
+
+	b, ok := goBinaries.builds[key]
+	if !ok {
+		// each build gets its own directory, so binaries with the same name
+		// built with different options don't collide
+		b = &goBuild{
+			out: filepath.Join(goBinaries.dir, strconv.Itoa(len(goBinaries.builds)+1), binaryName(pkgPath)),
+		}
+		goBinaries.builds[key] = b
+	}
+	goBinaries.Unlock()
+
+	b.once.Do(func() {
+		out := b.out
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			b.err = fmt.Errorf("build %s: %w", pkgPath, err)
+			return
+		}
+
+		cmd := osexec.Command("go", append(args, "-o", out, pkgPath)...)
+		cmd.Dir = opts.Dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			b.err = fmt.Errorf("go %s: %w\n%s", strings.Join(cmd.Args[1:], " "), err, strings.TrimSpace(string(output)))
+			return
+		}
+
+		b.path = out
+	})
+
+	return b.path, b.err
+}
+
+// binaryName returns the name of the binary go build would create for
+// pkgPath.
+func binaryName(pkgPath string) string {
+	name := path.Base(filepath.ToSlash(pkgPath))
+	if name == "." || name == "/" {
+		name = "main"
+	}
+
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+
+	return name
+}
@@ -0,0 +1,30 @@
+package exec
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestContextCommand(t *testing.T) {
+	bin := filepath.Join("build", "mytool")
+	tests := []struct {
+		binary  string
+		command string
+		want    string
+	}{
+		{"", "echo", "echo"},
+		{"", "", ""},
+		{bin, "", bin},
+		{bin, "mytool", bin},
+		{bin, "echo", "echo"},
+		{bin, "mytool2", "mytool2"},
+		{bin + ".exe", "mytool", bin + ".exe"},
+	}
+
+	for _, tt := range tests {
+		c := &TestContext{Binary: tt.binary}
+		if got := c.command(tt.command); got != tt.want {
+			t.Errorf("command(%q) with Binary %q = %q, want %q", tt.command, tt.binary, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// UpdateGolden causes golden file expectations to rewrite their files with
+// the actual output instead of comparing against them. It defaults to true
+// when the MELATONIN_UPDATE_GOLDEN environment variable is set to a
+// non-empty value, and may be bound to a test flag by callers.
+var UpdateGolden = os.Getenv("MELATONIN_UPDATE_GOLDEN") != ""
+
+func validateGolden(name, path, actual string, cfg DiffConfig) error {
+	if UpdateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("update golden file: %w", err)
+		}
+
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			return fmt.Errorf("update golden file: %w", err)
+		}
+
+		return nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("golden file %s does not exist; set MELATONIN_UPDATE_GOLDEN=1 to create it", path)
+		}
+
+		return fmt.Errorf("read golden file: %w", err)
+	}
+
+	if diff := cfg.unifiedDiff(path, name, string(b), actual); diff != "" {
+		return fmt.Errorf("%s does not match golden file %s:\n%s", name, path, diff)
+	}
+
+	return nil
+}
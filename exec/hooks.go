@@ -0,0 +1,167 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A Hook is run before or after the test cases in a context. A hook is
+// either a HookFunc or a *TestCase, whose errors are reported as the hook's
+// errors. A test case run as a hook doesn't run its own context's hooks.
+type Hook interface {
+	runHook(t *testing.T) []error
+}
+
+// A HookFunc is a Go function run as a hook.
+type HookFunc func() error
+
+func (f HookFunc) runHook(*testing.T) []error {
+	if err := f(); err != nil {
+		return []error{err}
+	}
+
+	return nil
+}
+
+func (tc *TestCase) runHook(t *testing.T) []error {
+	result, err := tc.execute(t)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", tc.Description(), err)}
+	}
+
+	var errs []error
+	for _, err := range result.errors {
+		errs = append(errs, fmt.Errorf("%s: %w", tc.Description(), err))
+	}
+
+	return errs
+}
+
+// BeforeAll adds hooks that are run once, before the first test case in this
+// context is executed. If a hook fails, no test cases in the context are run,
+// and the hook's errors are reported on each of their results.
+func (c *TestContext) BeforeAll(hooks ...Hook) *TestContext {
+	c.BeforeAllHooks = append(c.BeforeAllHooks, hooks...)
+	return c
+}
+
+// BeforeEach adds hooks that are run before each test case in this context.
+// If a hook fails, the test case isn't run, and the hook's errors are
+// reported on its result.
+func (c *TestContext) BeforeEach(hooks ...Hook) *TestContext {
+	c.BeforeEachHooks = append(c.BeforeEachHooks, hooks...)
+	return c
+}
+
+// AfterEach adds hooks that are run after each test case in this context,
+// whether or not it passed. A hook's errors are reported on the test case's
+// result.
+func (c *TestContext) AfterEach(hooks ...Hook) *TestContext {
+	c.AfterEachHooks = append(c.AfterEachHooks, hooks...)
+	return c
+}
+
+// AfterAll adds hooks that are run by the test case returned by Teardown,
+// after all other test cases in this context. Like any other test case,
+// Teardown isn't run if the test runner stops at an earlier failure, so
+// cleanup that must always happen belongs in t.Cleanup instead.
+func (c *TestContext) AfterAll(hooks ...Hook) *TestContext {
+	c.AfterAllHooks = append(c.AfterAllHooks, hooks...)
+	return c
+}
+
+// Teardown returns a test case that runs this context's AfterAll hooks,
+// reporting their errors on its result, kills any of the context's
+// background processes that haven't been stopped, and then writes its
+// coverage profile if one was requested with WithCoverProfile. It should be
+// the last test case run in the context. Afterwards, the context's BeforeAll
+// hooks will run again if another of its test cases is executed.
+//
+// Unless the test runner is created WithContinueOnFailure(true), a failing
+// test case stops it before Teardown runs, so neither the AfterAll hooks nor
+// the rest of Teardown's work is done. Use t.Cleanup for cleanup that must
+// always happen, such as KillBackground.
+func (c *TestContext) Teardown(description ...string) *TestCase {
+	desc := strings.Join(description, ", ")
+	if desc == "" {
+		desc = "tear down"
+	}
+
+	return &TestCase{
+		Desc:         desc,
+		Expectations: Expectations{},
+
+		tctx:      c,
+		tearsDown: true,
+	}
+}
+
+// runBeforeHooks runs the context's BeforeAll hooks, if they haven't been
+// run already, followed by its BeforeEach hooks.
+func (c *TestContext) runBeforeHooks(t *testing.T) []error {
+	if c == nil {
+		return nil
+	}
+
+	c.hooksMu.Lock()
+	if !c.ranBeforeAll {
+		c.beforeAllErrors = runHooks(t, "before all", c.BeforeAllHooks)
+		c.ranBeforeAll = true
+	}
+
+	errs := c.beforeAllErrors
+	c.hooksMu.Unlock()
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return runHooks(t, "before each", c.BeforeEachHooks)
+}
+
+func (c *TestContext) runAfterEachHooks(t *testing.T) []error {
+	if c == nil {
+		return nil
+	}
+
+	return runHooks(t, "after each", c.AfterEachHooks)
+}
+
+// tearDown runs the context's AfterAll hooks, resets its BeforeAll hooks,
+// kills its background processes and writes its coverage profile.
+func (c *TestContext) tearDown(t *testing.T, tc *TestCase) *TestResult {
+	c.hooksMu.Lock()
+	c.ranBeforeAll = false
+	c.beforeAllErrors = nil
+	c.hooksMu.Unlock()
+
+	result := &TestResult{
+		CoverDir: c.CoverDir,
+		testCase: tc,
+		errors:   runHooks(t, "after all", c.AfterAllHooks),
+	}
+
+	c.KillBackground()
+
+	if c.CoverDir != "" && c.CoverProfile != "" {
+		if err := c.WriteCoverProfile(c.CoverProfile); err != nil {
+			result.errors = append(result.errors, fmt.Errorf("write coverage profile: %w", err))
+		}
+	}
+
+	return result
+}
+
+// runHooks runs every hook, returning their errors prefixed with the kind
+// and number of the hook that failed.
+func runHooks(t *testing.T, kind string, hooks []Hook) []error {
+	var errs []error
+	for i, hook := range hooks {
+		for _, err := range hook.runHook(t) {
+			errs = append(errs, fmt.Errorf("%s hook %d: %w", kind, i+1, err))
+		}
+	}
+
+	return errs
+}
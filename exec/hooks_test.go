@@ -0,0 +1,110 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHookFailures(t *testing.T) {
+	type outcome struct {
+		ran bool
+		err string // substring of the case's errors, or "" if it passes
+	}
+
+	tests := []struct {
+		name  string
+		add   func(c *TestContext, hooks ...Hook) *TestContext
+		fails int // the call on which the hook fails
+		calls int
+		want  []outcome
+	}{
+		{
+			name:  "before all",
+			add:   (*TestContext).BeforeAll,
+			fails: 1,
+			calls: 1,
+			want: []outcome{
+				{false, "before all hook 1: call 1 failed"},
+				{false, "before all hook 1: call 1 failed"},
+				{false, "before all hook 1: call 1 failed"},
+			},
+		},
+		{
+			name:  "before each",
+			add:   (*TestContext).BeforeEach,
+			fails: 2,
+			calls: 3,
+			want: []outcome{
+				{true, ""},
+				{false, "before each hook 1: call 2 failed"},
+				{true, ""},
+			},
+		},
+		{
+			name:  "after each",
+			add:   (*TestContext).AfterEach,
+			fails: 1,
+			calls: 3,
+			want: []outcome{
+				{true, "after each hook 1: call 1 failed"},
+				{true, ""},
+				{true, ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			ctx := tt.add(NewTestContext(), HookFunc(func() error {
+				calls++
+				if calls == tt.fails {
+					return fmt.Errorf("call %d failed", calls)
+				}
+
+				return nil
+			}))
+
+			for i, want := range tt.want {
+				result, err := ctx.Run("echo").WithArgs("ran").Execute(t)
+				if err != nil {
+					t.Fatalf("case %d: %v", i+1, err)
+				}
+
+				if ran := result.(*TestResult).Stdout == "ran\n"; ran != want.ran {
+					t.Errorf("case %d: expected ran to be %t, got %t", i+1, want.ran, ran)
+				}
+
+				errs := result.Errors()
+				if want.err == "" {
+					if len(errs) > 0 {
+						t.Errorf("case %d: expected no errors, got %v", i+1, errs)
+					}
+				} else if msg := fmt.Sprint(errs); !strings.Contains(msg, want.err) {
+					t.Errorf("case %d: expected errors to contain %q, got %s", i+1, want.err, msg)
+				}
+			}
+
+			if calls != tt.calls {
+				t.Errorf("expected the hook to be called %d times, got %d", tt.calls, calls)
+			}
+		})
+	}
+}
+
+func TestAfterAllFailure(t *testing.T) {
+	ctx := NewTestContext().AfterAll(HookFunc(func() error {
+		return errors.New("cleanup failed")
+	}))
+
+	result, err := ctx.Teardown().Execute(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := fmt.Sprint(result.Errors()); !strings.Contains(msg, "after all hook 1: cleanup failed") {
+		t.Errorf("expected errors to contain the hook's error, got %s", msg)
+	}
+}
@@ -0,0 +1,210 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// An HTTPStub is a local HTTP server that serves canned responses to a
+// command. The server's URL is passed to the command in the environment
+// variable named by EnvVar.
+type HTTPStub struct {
+	EnvVar string
+	Routes []HTTPRoute
+}
+
+// An HTTPRoute is a canned response to requests with the given method and
+// path. An empty Method or Path matches any method or path, and the first
+// matching route is used. Status defaults to 200 OK.
+type HTTPRoute struct {
+	Method  string
+	Path    string
+	Status  int
+	Headers map[string]string
+	Body    string
+}
+
+// An HTTPRequest is a request received by an HTTP stub.
+type HTTPRequest struct {
+	// EnvVar identifies the stub that received the request.
+	EnvVar string
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// An HTTPRequestExpectation describes a request an HTTP stub is expected to
+// receive. If Path contains a query string, it must also match. An empty Body
+// matches any body.
+type HTTPRequestExpectation struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// WithHTTPStub starts a local HTTP server serving routes while the command
+// runs, and sets the environment variable envVar to its URL (for example,
+// http://127.0.0.1:54321). Requests that match no route receive 404 Not
+// Found. Every request received is recorded in the result's HTTPRequests.
+//
+//	exec.Run("mytool").
+//		WithArgs("sync").
+//		WithHTTPStub("MYTOOL_API_URL",
+//			exec.HTTPRoute{Method: "GET", Path: "/items", Body: `[{"id": 1}]`},
+//			exec.HTTPRoute{Method: "POST", Path: "/items", Status: 201},
+//		).
+//		ExpectHTTPRequest("POST", "/items", `{"id":2}`)
+func (tc *TestCase) WithHTTPStub(envVar string, routes ...HTTPRoute) *TestCase {
+	for _, s := range tc.HTTPStubs {
+		if s.EnvVar == envVar {
+			s.Routes = append(s.Routes, routes...)
+			return tc
+		}
+	}
+
+	tc.HTTPStubs = append(tc.HTTPStubs, &HTTPStub{EnvVar: envVar, Routes: routes})
+	return tc
+}
+
+// ExpectHTTPRequest expects an HTTP stub to have received a request with the
+// given method, path and body. If path contains a query string, it must also
+// match; if body is empty, any body matches.
+func (tc *TestCase) ExpectHTTPRequest(method, path, body string) *TestCase {
+	tc.Expectations.HTTPRequests = append(tc.Expectations.HTTPRequests, &HTTPRequestExpectation{
+		Method: method,
+		Path:   path,
+		Body:   body,
+	})
+
+	return tc
+}
+
+func (e *HTTPRequestExpectation) matches(req HTTPRequest) bool {
+	path := req.Path
+	if strings.Contains(e.Path, "?") {
+		path += "?" + req.Query
+	}
+
+	return req.Method == e.Method && path == e.Path && (e.Body == "" || req.Body == e.Body)
+}
+
+func (r *TestResult) validateHTTPRequest(e *HTTPRequestExpectation) {
+	var got []string
+	for _, req := range r.HTTPRequests {
+		if e.matches(req) {
+			return
+		}
+
+		got = append(got, req.Method+" "+req.Path)
+	}
+
+	desc := e.Method + " " + e.Path
+	if e.Body != "" {
+		desc += fmt.Sprintf(" with body %q", e.Body)
+	}
+
+	if len(got) == 0 {
+		r.errors = append(r.errors, fmt.Errorf("expected HTTP request %s, but no requests were received", desc))
+	} else {
+		r.errors = append(r.errors, fmt.Errorf("expected HTTP request %s, got %s", desc, strings.Join(got, ", ")))
+	}
+}
+
+// httpStubs returns the HTTP stubs for the test case and, for a pipeline, its
+// stages.
+func (tc *TestCase) httpStubs() []*HTTPStub {
+	stubs := tc.HTTPStubs
+	for _, stage := range tc.Pipeline {
+		stubs = append(stubs, stage.HTTPStubs...)
+	}
+
+	return stubs
+}
+
+// httpServers are the running servers for a test case's HTTP stubs, and the
+// requests they have received.
+type httpServers struct {
+	servers  []*httptest.Server
+	env      map[string]string
+	mu       sync.Mutex
+	requests []HTTPRequest
+}
+
+func startHTTPServers(stubs []*HTTPStub) *httpServers {
+	if len(stubs) == 0 {
+		return nil
+	}
+
+	h := &httpServers{env: map[string]string{}}
+	for _, stub := range stubs {
+		server := httptest.NewServer(h.handler(stub))
+		h.servers = append(h.servers, server)
+		h.env[stub.EnvVar] = server.URL
+	}
+
+	return h
+}
+
+func (h *httpServers) handler(stub *HTTPStub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		h.mu.Lock()
+		h.requests = append(h.requests, HTTPRequest{
+			EnvVar: stub.EnvVar,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: r.Header.Clone(),
+			Body:   string(body),
+		})
+		h.mu.Unlock()
+
+		for _, route := range stub.Routes {
+			if (route.Method == "" || route.Method == r.Method) && (route.Path == "" || route.Path == r.URL.Path) {
+				for k, v := range route.Headers {
+					w.Header().Set(k, v)
+				}
+
+				status := route.Status
+				if status == 0 {
+					status = http.StatusOK
+				}
+
+				w.WriteHeader(status)
+				io.WriteString(w, route.Body)
+				return
+			}
+		}
+
+		http.Error(w, fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+	})
+}
+
+// received returns the requests received so far, in the order they arrived.
+func (h *httpServers) received() []HTTPRequest {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]HTTPRequest(nil), h.requests...)
+}
+
+// close shuts down the servers, if there are any.
+func (h *httpServers) close() {
+	if h == nil {
+		return
+	}
+
+	for _, server := range h.servers {
+		server.Close()
+	}
+}
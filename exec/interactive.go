@@ -0,0 +1,206 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStepTimeout = 10 * time.Second
+
+// A DialogueStep is one exchange in an interactive session. If Pattern is set,
+// the step waits for the command's stdout to match it; then, if Input is set,
+// the step writes Input to the command's stdin.
+type DialogueStep struct {
+	Pattern *regexp.Regexp
+	Input   string
+	Timeout time.Duration
+}
+
+// WaitFor adds a step to the test case's dialogue that waits for stdout to
+// match the pattern. Only output written since the previous match is searched.
+func (tc *TestCase) WaitFor(pattern *regexp.Regexp) *TestCase {
+	tc.Dialogue = append(tc.Dialogue, DialogueStep{Pattern: pattern})
+	return tc
+}
+
+// WaitForWithin is like WaitFor, but overrides the step timeout.
+func (tc *TestCase) WaitForWithin(pattern *regexp.Regexp, timeout time.Duration) *TestCase {
+	tc.Dialogue = append(tc.Dialogue, DialogueStep{Pattern: pattern, Timeout: timeout})
+	return tc
+}
+
+// Send adds a step to the test case's dialogue that writes input to stdin.
+func (tc *TestCase) Send(input string) *TestCase {
+	tc.Dialogue = append(tc.Dialogue, DialogueStep{Input: input})
+	return tc
+}
+
+// SendLine is like Send, but terminates the input with a newline.
+func (tc *TestCase) SendLine(line string) *TestCase {
+	return tc.Send(line + "\n")
+}
+
+// WithStepTimeout sets how long each step of the dialogue waits for output,
+// unless overridden by the step.
+func (tc *TestCase) WithStepTimeout(timeout time.Duration) *TestCase {
+	tc.StepTimeout = timeout
+	return tc
+}
+
+// converse writes input, if any, to stdin, then carries out the test case's
+// dialogue, closing stdin once all steps are complete.
+func (tc *TestCase) converse(stdin io.WriteCloser, input io.Reader, stdout *outputBuffer, exited <-chan struct{}) error {
+	defer stdin.Close()
+
+	if input != nil {
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return fmt.Errorf("read stdin: %w", err)
+		}
+
+		stdout.transcript.add('>', string(data))
+		if _, err := stdin.Write(data); err != nil {
+			return fmt.Errorf("send stdin: %w", err)
+		}
+	}
+
+	pos := 0
+	for i, step := range tc.Dialogue {
+		if step.Pattern != nil {
+			timeout := step.Timeout
+			if timeout == 0 {
+				timeout = tc.StepTimeout
+			}
+
+			if timeout == 0 {
+				timeout = defaultStepTimeout
+			}
+
+			end, err := stdout.waitFor(step.Pattern, pos, timeout, exited)
+			if err != nil {
+				return fmt.Errorf("dialogue step %d: %w", i+1, err)
+			}
+
+			pos = end
+		}
+
+		if step.Input != "" {
+			stdout.transcript.add('>', step.Input)
+			if _, err := io.WriteString(stdin, step.Input); err != nil {
+				return fmt.Errorf("dialogue step %d: send %q: %w", i+1, step.Input, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// outputBuffer collects a command's output, allowing it to be observed
+// while the command is still running.
+type outputBuffer struct {
+	mu         sync.Mutex
+	buf        strings.Builder
+	changed    chan struct{}
+	transcript *transcript
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf.Write(p)
+	if b.transcript != nil {
+		b.transcript.add('<', string(p))
+	}
+
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+
+	return len(p), nil
+}
+
+func (b *outputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// snapshot returns the output so far and a channel that is closed when more
+// output is written.
+func (b *outputBuffer) snapshot() (string, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+
+	return b.buf.String(), b.changed
+}
+
+// waitFor waits for the output following pos to match pattern, returning the
+// position of the end of the match.
+func (b *outputBuffer) waitFor(pattern *regexp.Regexp, pos int, timeout time.Duration, exited <-chan struct{}) (int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		output, changed := b.snapshot()
+		if loc := pattern.FindStringIndex(output[pos:]); loc != nil {
+			return pos + loc[1], nil
+		}
+
+		select {
+		case <-changed:
+		case <-exited:
+			// all output has been written once the command has exited
+			if loc := pattern.FindStringIndex(b.String()[pos:]); loc != nil {
+				return pos + loc[1], nil
+			}
+
+			return 0, fmt.Errorf("command exited while waiting for stdout to match /%s/", pattern)
+		case <-timer.C:
+			return 0, fmt.Errorf("timed out after %s waiting for stdout to match /%s/", timeout, pattern)
+		}
+	}
+}
+
+// A transcript records the output received from and input sent to a command
+// during an interactive session.
+type transcript struct {
+	mu  sync.Mutex
+	buf strings.Builder
+	dir byte
+}
+
+func (t *transcript) add(dir byte, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, line := range splitLines(text) {
+		if t.dir != dir || t.buf.Len() == 0 || strings.HasSuffix(t.buf.String(), "\n") {
+			if t.buf.Len() > 0 && !strings.HasSuffix(t.buf.String(), "\n") {
+				t.buf.WriteByte('\n')
+			}
+
+			t.buf.WriteString(string(dir) + " ")
+			t.dir = dir
+		}
+
+		t.buf.WriteString(line)
+	}
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.buf.String()
+}
@@ -0,0 +1,188 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jefflinse/melatonin/expect"
+)
+
+// ExpectStdoutLines expects stdout to consist of exactly the given lines, in
+// order. A trailing newline and carriage returns at the ends of lines are
+// ignored.
+func (tc *TestCase) ExpectStdoutLines(lines ...string) *TestCase {
+	tc.Expectations.StdoutLines = append([]string{}, lines...)
+	tc.Expectations.WantUnorderedStdoutLines = false
+	return tc
+}
+
+// ExpectStdoutLinesUnordered expects stdout to consist of exactly the given
+// lines, in any order. A line given more than once must appear that many
+// times.
+func (tc *TestCase) ExpectStdoutLinesUnordered(lines ...string) *TestCase {
+	tc.Expectations.StdoutLines = append([]string{}, lines...)
+	tc.Expectations.WantUnorderedStdoutLines = true
+	return tc
+}
+
+// ExpectStderrLines expects stderr to consist of exactly the given lines, in
+// order. See ExpectStdoutLines.
+func (tc *TestCase) ExpectStderrLines(lines ...string) *TestCase {
+	tc.Expectations.StderrLines = append([]string{}, lines...)
+	tc.Expectations.WantUnorderedStderrLines = false
+	return tc
+}
+
+// ExpectStderrLinesUnordered expects stderr to consist of exactly the given
+// lines, in any order. See ExpectStdoutLinesUnordered.
+func (tc *TestCase) ExpectStderrLinesUnordered(lines ...string) *TestCase {
+	tc.Expectations.StderrLines = append([]string{}, lines...)
+	tc.Expectations.WantUnorderedStderrLines = true
+	return tc
+}
+
+// ExpectLineCount expects stdout to have n lines.
+func (tc *TestCase) ExpectLineCount(n int) *TestCase {
+	tc.Expectations.StdoutLineCount = &n
+	return tc
+}
+
+// ExpectStderrLineCount expects stderr to have n lines.
+func (tc *TestCase) ExpectStderrLineCount(n int) *TestCase {
+	tc.Expectations.StderrLineCount = &n
+	return tc
+}
+
+// ExpectStdoutJSONLine expects at least one line of stdout, read as
+// newline-delimited JSON, to match the expected value. Objects match if they
+// contain the expected fields; other fields are ignored. Lines that aren't
+// JSON are skipped.
+func (tc *TestCase) ExpectStdoutJSONLine(expected interface{}) *TestCase {
+	tc.Expectations.StdoutJSONLines = append(tc.Expectations.StdoutJSONLines, expected)
+	return tc
+}
+
+// ExpectStderrJSONLine expects at least one line of stderr, read as
+// newline-delimited JSON, to match the expected value. See
+// ExpectStdoutJSONLine.
+//
+//	exec.Run("myservice").
+//		WithArgs("--log-format", "json").
+//		ExpectStderrJSONLine(json.Object{
+//			"level": "info",
+//			"msg":   "listening",
+//		})
+func (tc *TestCase) ExpectStderrJSONLine(expected interface{}) *TestCase {
+	tc.Expectations.StderrJSONLines = append(tc.Expectations.StderrJSONLines, expected)
+	return tc
+}
+
+func (r *TestResult) validateLines(name, output string, expected []string, unordered bool, cfg DiffConfig) {
+	if expected == nil {
+		return
+	}
+
+	actual := outputLines(output)
+	if !unordered {
+		if want, got := joinLines(expected), joinLines(actual); want != got {
+			r.errors = append(r.errors, cfg.mismatch(name+" lines", want, got))
+		}
+
+		return
+	}
+
+	remaining := map[string]int{}
+	for _, line := range actual {
+		remaining[line]++
+	}
+
+	var missing []string
+	for _, line := range expected {
+		if remaining[line] == 0 {
+			missing = append(missing, line)
+			continue
+		}
+
+		remaining[line]--
+	}
+
+	var unexpected []string
+	for line, n := range remaining {
+		for i := 0; i < n; i++ {
+			unexpected = append(unexpected, line)
+		}
+	}
+	sort.Strings(unexpected)
+
+	if len(missing) > 0 {
+		r.errors = append(r.errors, fmt.Errorf("expected %s to contain lines %q, got %q", name, missing, actual))
+	}
+
+	if len(unexpected) > 0 {
+		r.errors = append(r.errors, fmt.Errorf("expected %s not to contain lines %q, got %q", name, unexpected, actual))
+	}
+}
+
+func (r *TestResult) validateLineCount(name, output string, expected *int) {
+	if expected == nil {
+		return
+	}
+
+	if n := len(outputLines(output)); n != *expected {
+		r.errors = append(r.errors, fmt.Errorf("expected %s to have %d lines, got %d", name, *expected, n))
+	}
+}
+
+func (r *TestResult) validateJSONLine(name, output string, expected interface{}) {
+	records := 0
+	for i, line := range outputLines(output) {
+		var actual interface{}
+		if err := json.Unmarshal([]byte(line), &actual); err != nil {
+			continue
+		}
+
+		records++
+		if errs := expect.Value(fmt.Sprintf("%s line %d", name, i+1), expected, actual, false); len(errs) == 0 {
+			return
+		}
+	}
+
+	desc, err := json.Marshal(expected)
+	if err != nil {
+		desc = []byte(fmt.Sprint(expected))
+	}
+
+	if records == 0 {
+		r.errors = append(r.errors, fmt.Errorf("expected %s to contain a JSON line matching %s, but it has no JSON lines, got %q", name, desc, output))
+	} else {
+		r.errors = append(r.errors, fmt.Errorf("expected %s to contain a JSON line matching %s, but none of its %d JSON lines match, got %q", name, desc, records, output))
+	}
+}
+
+// outputLines splits output into lines, ignoring a trailing newline and
+// carriage returns at the ends of lines.
+func outputLines(output string) []string {
+	if output == "" {
+		return []string{}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	return lines
+}
+
+// joinLines joins lines, terminating each with a newline.
+func joinLines(lines []string) string {
+	b := &strings.Builder{}
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,28 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOutputLines(t *testing.T) {
+	tests := []struct {
+		output string
+		lines  []string
+	}{
+		{"", []string{}},
+		{"\n", []string{""}},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a"}},
+		{"a\nb", []string{"a", "b"}},
+		{"a\n\nb\n", []string{"a", "", "b"}},
+		{"a\r\nb\r\n", []string{"a", "b"}},
+		{"a\n\n", []string{"a", ""}},
+	}
+
+	for _, tt := range tests {
+		if lines := outputLines(tt.output); !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("outputLines(%q) = %q, want %q", tt.output, lines, tt.lines)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A Normalizer rewrites a command's stdout or stderr before it is checked
+// against expectations, typically to replace values that differ from run to
+// run with fixed placeholders.
+type Normalizer func(output string, result *TestResult) string
+
+var (
+	uuidPattern      = regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`)
+	timestampPattern = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+	durationPattern  = regexp.MustCompile(`(?m)(^|[^\w.])(\d+(\.\d+)?(ns|us|µs|ms|h|m|s))+\b`)
+)
+
+// ReplaceMatches returns a normalizer that replaces matches of pattern with
+// replacement, which may refer to submatches as in regexp.ReplaceAllString.
+func ReplaceMatches(pattern *regexp.Regexp, replacement string) Normalizer {
+	return func(output string, _ *TestResult) string {
+		return pattern.ReplaceAllString(output, replacement)
+	}
+}
+
+// ScrubUUIDs is a normalizer that replaces UUIDs with <UUID>.
+func ScrubUUIDs(output string, _ *TestResult) string {
+	return uuidPattern.ReplaceAllString(output, "<UUID>")
+}
+
+// ScrubTimestamps is a normalizer that replaces RFC 3339 and similar ISO 8601
+// timestamps, such as 2006-01-02T15:04:05Z or 2006-01-02 15:04:05.999, with
+// <TIMESTAMP>.
+func ScrubTimestamps(output string, _ *TestResult) string {
+	return timestampPattern.ReplaceAllString(output, "<TIMESTAMP>")
+}
+
+// ScrubDurations is a normalizer that replaces durations formatted like Go's
+// time.Duration, such as 150ms or 1m30.5s, with <DURATION>. Durations that
+// are part of a longer word or number, such as the 2s in v1.2s, are left
+// alone.
+func ScrubDurations(output string, _ *TestResult) string {
+	return durationPattern.ReplaceAllString(output, "${1}<DURATION>")
+}
+
+// ScrubTempPaths is a normalizer that replaces paths inside the system's
+// temporary directory with <TMP>. Sandboxes are created in the temporary
+// directory, so ScrubSandboxDir must come first to preserve paths within the
+// sandbox.
+func ScrubTempPaths(output string, _ *TestResult) string {
+	for _, dir := range tempDirs() {
+		// the path mustn't be part of a longer path, such as <SANDBOX>/tmp
+		pattern := regexp.MustCompile(`(?m)(^|[^\w.>/\\-])` + regexp.QuoteMeta(dir) + `([/\\][^\s"'<>]*)?`)
+		scrubbed := &strings.Builder{}
+		last := 0
+		for _, m := range pattern.FindAllStringSubmatchIndex(output, -1) {
+			// nor may it be the start of a longer name, such as /tmpfile
+			if m[4] < 0 && m[1] < len(output) && isNameChar(output[m[1]]) {
+				continue
+			}
+
+			scrubbed.WriteString(output[last:m[3]])
+			scrubbed.WriteString("<TMP>")
+			last = m[1]
+		}
+
+		scrubbed.WriteString(output[last:])
+		output = scrubbed.String()
+	}
+
+	return output
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// ScrubSandboxDir is a normalizer that replaces the path of the command's
+// sandbox with <SANDBOX>, so that the working directory of a sandboxed
+// command appears as <SANDBOX>/work.
+func ScrubSandboxDir(output string, result *TestResult) string {
+	if result.SandboxDir == "" {
+		return output
+	}
+
+	return strings.ReplaceAll(output, result.SandboxDir, "<SANDBOX>")
+}
+
+// tempDirs returns the temporary directory, and the path it resolves to if
+// it's a symbolic link (e.g. on macOS).
+func tempDirs() []string {
+	dir := filepath.Clean(os.TempDir())
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil || resolved == dir {
+		return []string{dir}
+	}
+
+	// replace the longer path first, in case one contains the other
+	if len(resolved) > len(dir) {
+		return []string{resolved, dir}
+	}
+
+	return []string{dir, resolved}
+}
+
+// WithNormalizers adds normalizers that are applied to the output of every
+// test case in this context, before the test case's own normalizers.
+func (c *TestContext) WithNormalizers(normalizers ...Normalizer) *TestContext {
+	c.Normalizers = append(c.Normalizers, normalizers...)
+	return c
+}
+
+// WithNormalizers adds normalizers that are applied, in order, to the
+// command's stdout and stderr before any expectations are checked, including
+// golden files. Normalizers added to the test case's context are applied
+// first.
+//
+//	exec.Run("mytool").
+//		WithNormalizers(exec.ScrubSandboxDir, exec.ScrubTempPaths, exec.ScrubUUIDs).
+//		ExpectStdoutGolden("testdata/mytool.golden")
+func (tc *TestCase) WithNormalizers(normalizers ...Normalizer) *TestCase {
+	tc.Normalizers = append(tc.Normalizers, normalizers...)
+	return tc
+}
+
+// normalize applies the context's and the test case's normalizers to output.
+func (r *TestResult) normalize(output string) string {
+	tc := r.testCase
+	if tc.tctx != nil {
+		for _, n := range tc.tctx.Normalizers {
+			output = n(output, r)
+		}
+	}
+
+	for _, n := range tc.Normalizers {
+		output = n(output, r)
+	}
+
+	return output
+}
@@ -0,0 +1,42 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrubbers(t *testing.T) {
+	tmp := filepath.Clean(os.TempDir())
+	tests := []struct {
+		name       string
+		normalizer Normalizer
+		output     string
+		want       string
+	}{
+		{"ScrubUUIDs", ScrubUUIDs, "id 123e4567-e89b-12d3-a456-426614174000\n", "id <UUID>\n"},
+		{"ScrubUUIDs", ScrubUUIDs, "x123e4567-e89b-12d3-a456-426614174000", "x123e4567-e89b-12d3-a456-426614174000"},
+		{"ScrubTimestamps", ScrubTimestamps, "at 2006-01-02T15:04:05Z\n", "at <TIMESTAMP>\n"},
+		{"ScrubTimestamps", ScrubTimestamps, "at 2006-01-02 15:04:05.999+07:00", "at <TIMESTAMP>"},
+		{"ScrubDurations", ScrubDurations, "took 150ms\n", "took <DURATION>\n"},
+		{"ScrubDurations", ScrubDurations, "1m30.5s", "<DURATION>"},
+		{"ScrubDurations", ScrubDurations, "(2µs)", "(<DURATION>)"},
+		{"ScrubDurations", ScrubDurations, "a\n1s, 2s", "a\n<DURATION>, <DURATION>"},
+		{"ScrubDurations", ScrubDurations, "v1.2s", "v1.2s"},
+		{"ScrubDurations", ScrubDurations, "1.2.3s", "1.2.3s"},
+		{"ScrubDurations", ScrubDurations, "5mins", "5mins"},
+		{"ScrubTempPaths", ScrubTempPaths, tmp, "<TMP>"},
+		{"ScrubTempPaths", ScrubTempPaths, "open " + tmp + "/a/b.txt failed\n", "open <TMP> failed\n"},
+		{"ScrubTempPaths", ScrubTempPaths, `"` + tmp + `/a" and ` + tmp + "/b", `"<TMP>" and <TMP>`},
+		{"ScrubTempPaths", ScrubTempPaths, "<SANDBOX>" + tmp + "/a", "<SANDBOX>" + tmp + "/a"},
+		{"ScrubTempPaths", ScrubTempPaths, "/home/user" + tmp, "/home/user" + tmp},
+		{"ScrubTempPaths", ScrubTempPaths, tmp + "file " + tmp + "-x", tmp + "file " + tmp + "-x"},
+		{"ScrubTempPaths", ScrubTempPaths, "saved to " + tmp + ".", "saved to <TMP>."},
+	}
+
+	for _, tt := range tests {
+		if got := tt.normalizer(tt.output, &TestResult{}); got != tt.want {
+			t.Errorf("%s(%q) = %q, want %q", tt.name, tt.output, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Pipe returns a test case that runs the given test cases concurrently, with
+// the stdout of each connected to the stdin of the next, like a shell
+// pipeline. Expectations set on the individual stages are checked against
+// their own results, while expectations set on the returned test case are
+// checked against the pipeline as a whole. The timeout and sandbox of the
+// pipeline apply to all of its stages; timeouts, signals and sandboxes can't
+// be set on individual stages, stdin can only be set on the first stage, and
+// signals can't be sent to a pipeline.
+//
+// A stage that exits unsuccessfully fails the pipeline unless the stage
+// expects an exit code or signal, or, for the last stage, the pipeline does.
+// A stage other than the last whose output isn't all read, because a later
+// stage exited first, doesn't fail the pipeline, whether it is killed by
+// SIGPIPE or has already exited.
+func Pipe(stages ...*TestCase) *TestCase {
+	tc := &TestCase{
+		Expectations: Expectations{},
+		Pipeline:     append([]*TestCase{}, stages...),
+	}
+
+	if len(stages) > 0 {
+		tc.tctx = stages[0].tctx
+	}
+
+	return tc
+}
+
+func (tc *TestCase) runPipeline(t *testing.T) (*TestResult, error) {
+	if len(tc.Pipeline) == 0 {
+		return nil, errors.New("pipeline has no stages")
+	}
+
+	if len(tc.Signals) > 0 {
+		return nil, errors.New("signals can't be sent to a pipeline")
+	}
+
+	for i, stage := range tc.Pipeline {
+		if stage.Background || stage.Pipeline != nil || stage.PTY != nil || len(stage.Dialogue) > 0 {
+			return nil, fmt.Errorf("pipeline stage %d: background, pipeline, PTY and interactive test cases can't be piped", i+1)
+		}
+
+		if stage.Timeout != 0 || len(stage.Signals) > 0 {
+			return nil, fmt.Errorf("pipeline stage %d: timeouts and signals can't be set on a pipeline stage; set the timeout on the pipeline", i+1)
+		}
+
+		if stage.Sandbox != nil || stage.keepSandbox {
+			return nil, fmt.Errorf("pipeline stage %d: sandboxes can't be set on a pipeline stage; set the sandbox on the pipeline", i+1)
+		}
+
+		if i > 0 && stage.stdin != nil {
+			return nil, fmt.Errorf("pipeline stage %d: stdin can only be set on the first stage of a pipeline", i+1)
+		}
+	}
+
+	result := &TestResult{
+		testCase: tc,
+	}
+
+	sandbox, err := tc.prepare()
+	if err != nil {
+		return nil, err
+	}
+	defer tc.tearDownSandbox(t, sandbox, result)
+	defer tc.stubDir.remove()
+	defer tc.servers.close()
+
+	result.SandboxDir = sandbox.dir()
+	result.CoverDir = tc.coverDir
+	n := len(tc.Pipeline)
+	stdouts, stderrs := make([]*outputBuffer, n), make([]*outputBuffer, n)
+	pipes := make([]*os.File, n) // write end of the pipe to the next stage
+	for i, stage := range tc.Pipeline {
+		stdouts[i], stderrs[i] = &outputBuffer{}, &outputBuffer{}
+		stage.cmd.Stdout, stage.cmd.Stderr = stdouts[i], stderrs[i]
+		if i < n-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return nil, err
+			}
+
+			defer r.Close()
+			defer w.Close()
+			stage.cmd.Stdout = io.MultiWriter(stdouts[i], w)
+			tc.Pipeline[i+1].cmd.Stdin = r
+			pipes[i] = w
+		}
+	}
+
+	started := time.Now()
+	errs := make([]error, n)
+	durations := make([]time.Duration, n)
+	exited := make([]chan struct{}, n)
+	for i, stage := range tc.Pipeline {
+		exited[i] = make(chan struct{})
+		setProcessGroup(stage.cmd)
+		if errs[i] = stage.cmd.Start(); errs[i] != nil {
+			if pipes[i] != nil {
+				pipes[i].Close()
+			}
+
+			close(exited[i])
+			continue
+		}
+
+		go func(i int, cmd *osexec.Cmd) {
+			errs[i] = cmd.Wait()
+			durations[i] = time.Since(started)
+
+			// let the next stage see EOF
+			if pipes[i] != nil {
+				pipes[i].Close()
+			}
+
+			close(exited[i])
+		}(i, stage.cmd)
+	}
+
+	// the started stages have their own copies of the pipes now
+	for i := 1; i < n; i++ {
+		tc.Pipeline[i].cmd.Stdin.(*os.File).Close()
+	}
+
+	allExited := make(chan struct{})
+	go func() {
+		for _, ch := range exited {
+			<-ch
+		}
+
+		close(allExited)
+	}()
+
+	var deadline <-chan time.Time
+	if timeout := tc.timeout(); timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	select {
+	case <-allExited:
+	case <-deadline:
+		result.TimedOut = true
+		tc.signalPipeline(terminateProcessGroup)
+		select {
+		case <-allExited:
+		case <-time.After(tc.gracePeriod()):
+			tc.signalPipeline(killProcessGroup)
+			<-allExited
+		}
+	}
+
+	// stubs are shared by all stages, so each stage's result has every call
+	// and request
+	result.recordStubCalls(tc.stubDir)
+	result.HTTPRequests = tc.servers.received()
+
+	stderr := &strings.Builder{}
+	for i, stage := range tc.Pipeline {
+		stageResult := &TestResult{
+			Environment:  stage.cmd.Env,
+			SandboxDir:   result.SandboxDir,
+			CoverDir:     result.CoverDir,
+			StubCalls:    result.StubCalls,
+			HTTPRequests: result.HTTPRequests,
+			testCase:     stage,
+		}
+
+		stageResult.setProcessState(stage.cmd.ProcessState, durations[i])
+
+		if errs[i] != nil && !result.TimedOut && !tc.stageExitExpected(i, stageResult, errs[i]) {
+			stageResult.errors = append(stageResult.errors, commandError(errs[i]))
+		}
+
+		stageResult.setOutput(stdouts[i].String(), stderrs[i].String())
+		stageResult.validateExpectations()
+		for _, err := range stageResult.errors {
+			result.errors = append(result.errors, fmt.Errorf("stage %d (%s): %w", i+1, stage.Target(), err))
+		}
+
+		result.Stages = append(result.Stages, stageResult)
+		stderr.WriteString(stderrs[i].String())
+		result.UserTime += stageResult.UserTime
+		result.SystemTime += stageResult.SystemTime
+		if stageResult.MaxRSS > result.MaxRSS {
+			result.MaxRSS = stageResult.MaxRSS
+		}
+	}
+
+	last := result.Stages[n-1]
+	result.Duration = time.Since(started)
+	result.ExitCode = last.ExitCode
+	result.TerminatedBySignal, result.Signal = last.TerminatedBySignal, last.Signal
+	result.setOutput(stdouts[n-1].String(), stderr.String())
+	result.validateExpectations()
+
+	return result, nil
+}
+
+// stageExitExpected reports whether err, the unsuccessful exit status of the
+// pipeline's i'th stage, is expected and so isn't an error.
+func (tc *TestCase) stageExitExpected(i int, result *TestResult, err error) bool {
+	stage := tc.Pipeline[i]
+	if stage.expectsExitStatus(err) {
+		return true
+	}
+
+	if i == len(tc.Pipeline)-1 {
+		return tc.expectsExitStatus(err)
+	}
+
+	// a stage's output is copied to the next stage, so if the next stage
+	// exits first, the stage is either killed by SIGPIPE or, if it exits
+	// before the copy fails, its output is cut short with EPIPE
+	var exitErr *osexec.ExitError
+	if errors.As(err, &exitErr) {
+		return result.TerminatedBySignal && result.Signal == syscall.SIGPIPE
+	}
+
+	return errors.Is(err, syscall.EPIPE)
+}
+
+// signalPipeline sends a signal to the process group of each running stage.
+func (tc *TestCase) signalPipeline(signal func(*os.Process) error) {
+	for _, stage := range tc.Pipeline {
+		if stage.cmd.Process != nil {
+			signal(stage.cmd.Process)
+		}
+	}
+}
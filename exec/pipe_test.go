@@ -0,0 +1,112 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	tests := []struct {
+		name string
+		tc   *TestCase
+		want []string // substrings of the errors, if the pipeline should fail
+	}{
+		{
+			name: "success",
+			tc: Pipe(
+				Run("printf").WithArgs(`b\na\n`),
+				Run("sort"),
+			).ExpectStdout("a\nb\n"),
+		},
+		{
+			name: "unexpected stage exit status",
+			tc:   Pipe(Run("false"), Run("cat")),
+			want: []string{"stage 1 (false): exit status 1"},
+		},
+		{
+			name: "expected stage exit status",
+			tc:   Pipe(Run("false").ExpectExitCode(1), Run("cat")),
+		},
+		{
+			name: "unexpected last stage exit status",
+			tc:   Pipe(Run("true"), Run("false")),
+			want: []string{"stage 2 (false): exit status 1"},
+		},
+		{
+			name: "last stage exit status expected by the pipeline",
+			tc:   Pipe(Run("true"), Run("false")).ExpectExitCode(1),
+		},
+		{
+			name: "last stage signal expected by the pipeline",
+			tc: Pipe(
+				Run("echo").WithArgs("x"),
+				Run("sh").WithArgs("-c", "kill -TERM $$"),
+			).ExpectSignal(syscall.SIGTERM),
+		},
+		{
+			name: "stage killed by SIGPIPE",
+			tc: Pipe(
+				Run("yes"),
+				Run("head").WithArgs("-n", "1"),
+			).ExpectStdout("y\n"),
+		},
+		{
+			name: "stage writing after the next stage exits",
+			tc: Pipe(
+				Run("sh").WithArgs("-c", "sleep 0.2; echo x"),
+				Run("true"),
+			).ExpectExitCode(0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.tc.Execute(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs := result.Errors()
+			if tt.want == nil {
+				if len(errs) > 0 {
+					t.Errorf("expected no errors, got %v", errs)
+				}
+
+				return
+			}
+
+			msg := fmt.Sprint(errs)
+			for _, want := range tt.want {
+				if !strings.Contains(msg, want) {
+					t.Errorf("expected errors to contain %q, got %s", want, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestPipeRejectsStageTimeouts(t *testing.T) {
+	tc := Pipe(Run("true").WithTimeout(time.Second), Run("cat"))
+	if _, err := tc.Execute(t); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestPipeRejectsStageSandboxes(t *testing.T) {
+	for _, stage := range []*TestCase{Run("pwd").WithSandbox(""), Run("pwd").KeepSandboxOnFailure()} {
+		tc := Pipe(stage, Run("cat"))
+		if _, err := tc.Execute(t); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
+
+func TestPipeRejectsStageStdin(t *testing.T) {
+	tc := Pipe(Run("echo").WithArgs("a"), Run("cat").WithStdin(strings.NewReader("b\n")))
+	if _, err := tc.Execute(t); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+	"syscall"
+)
+
+// setProcessGroup places the command in a new process group so that it and
+// any processes it spawns can be signaled together. Commands started in a new
+// session already lead their own process group.
+func setProcessGroup(cmd *osexec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = !cmd.SysProcAttr.Setsid
+}
+
+func terminateProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
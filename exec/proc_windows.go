@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+)
+
+// Process groups can't be signaled on Windows, so only the command's own
+// process is killed.
+func setProcessGroup(cmd *osexec.Cmd) {}
+
+func terminateProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
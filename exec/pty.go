@@ -0,0 +1,49 @@
+package exec
+
+import (
+	"os"
+	"regexp"
+)
+
+// PTYConfig describes the pseudo-terminal a command is attached to.
+type PTYConfig struct {
+	Rows uint16
+	Cols uint16
+}
+
+// WithPTY runs the command attached to a pseudo-terminal of the given size,
+// so that it behaves as it would when run interactively. The command's stdin,
+// stdout and stderr are all connected to the terminal, and everything it
+// writes is captured as stdout. Pseudo-terminals are only supported on Linux.
+func (tc *TestCase) WithPTY(rows, cols uint16) *TestCase {
+	tc.PTY = &PTYConfig{Rows: rows, Cols: cols}
+	return tc
+}
+
+// WithANSIStripped removes ANSI escape sequences, such as colors and cursor
+// movements, from stdout and stderr before they are checked.
+func (tc *TestCase) WithANSIStripped() *TestCase {
+	tc.StripANSI = true
+	return tc
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+func stripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// ptyInput writes to a pseudo-terminal. Closing it sends end-of-file to the
+// terminal rather than closing the terminal itself.
+type ptyInput struct {
+	master *os.File
+}
+
+func (p *ptyInput) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+func (p *ptyInput) Close() error {
+	_, err := p.master.Write([]byte{0x04})
+	return err
+}
@@ -0,0 +1,85 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY opens a new pseudo-terminal with the given size, returning its
+// master and slave ends.
+func openPTY(rows, cols uint16) (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open pty: %w", err)
+	}
+
+	slave, err := openPTYSlave(master, rows, cols)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("open pty: %w", err)
+	}
+
+	return master, slave, nil
+}
+
+func openPTYSlave(master *os.File, rows, cols uint16) (*os.File, error) {
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return nil, err
+	}
+
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return nil, err
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't translate "\n" to "\r\n", so that output is captured exactly as
+	// the command wrote it.
+	var termios syscall.Termios
+	if err := ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); err != nil {
+		slave.Close()
+		return nil, err
+	}
+
+	termios.Oflag &^= syscall.ONLCR
+	if err := ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&termios))); err != nil {
+		slave.Close()
+		return nil, err
+	}
+
+	ws := struct{ rows, cols, x, y uint16 }{rows, cols, 0, 0}
+	if err := ioctl(slave.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		slave.Close()
+		return nil, err
+	}
+
+	return slave, nil
+}
+
+// setControllingTerminal starts the command in a new session with its stdin
+// as the controlling terminal.
+func setControllingTerminal(cmd *osexec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
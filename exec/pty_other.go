@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+import (
+	"errors"
+	"os"
+	osexec "os/exec"
+)
+
+func openPTY(rows, cols uint16) (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pseudo-terminals are only supported on Linux")
+}
+
+func setControllingTerminal(cmd *osexec.Cmd) {}
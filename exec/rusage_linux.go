@@ -0,0 +1,15 @@
+package exec
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSS returns the maximum resident set size of the process in bytes.
+func maxRSS(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return int64(rusage.Maxrss) * 1024
+	}
+
+	return 0
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+import "os"
+
+// maxRSS returns 0, as the maximum resident set size of a process is only
+// reported on Linux.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
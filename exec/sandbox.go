@@ -0,0 +1,370 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// SandboxConfig describes the isolated directory a command is run in.
+type SandboxConfig struct {
+	// Fixture is a directory tree or txtar archive (a file ending in
+	// ".txtar") copied into the sandbox before the command runs. If empty,
+	// the sandbox starts out empty.
+	Fixture string
+
+	// KeepOnFailure prevents the sandbox from being removed when the test
+	// case fails, so that it can be inspected.
+	KeepOnFailure bool
+}
+
+// WithSandbox runs each test case in this context in its own sandbox. See
+// TestCase.WithSandbox.
+func (c *TestContext) WithSandbox(fixture string) *TestContext {
+	c.Sandbox = &SandboxConfig{Fixture: fixture}
+	return c
+}
+
+// KeepSandboxOnFailure keeps the sandboxes of failed test cases in this
+// context. It applies to every test case that runs in a sandbox, whether the
+// sandbox is configured before or after it is called.
+func (c *TestContext) KeepSandboxOnFailure() *TestContext {
+	c.keepSandbox = true
+	return c
+}
+
+// WithSandbox runs the command in a fresh temporary directory populated
+// with the contents of fixture, which may be a directory or a txtar archive.
+// HOME, TMPDIR and the XDG base directories are pointed at directories inside
+// the sandbox, and the sandbox is removed once the test case completes.
+//
+// A relative working directory set with WithWorkingDir is resolved against
+// the sandbox.
+func (tc *TestCase) WithSandbox(fixture string) *TestCase {
+	tc.Sandbox = &SandboxConfig{Fixture: fixture}
+	return tc
+}
+
+// KeepSandboxOnFailure keeps the sandbox if the test case fails. It has no
+// effect unless the test case runs in a sandbox, which may be configured
+// before or after it is called, on the test case or its context.
+func (tc *TestCase) KeepSandboxOnFailure() *TestCase {
+	tc.keepSandbox = true
+	return tc
+}
+
+func (tc *TestCase) sandbox() *SandboxConfig {
+	if tc.Sandbox != nil {
+		return tc.Sandbox
+	}
+
+	return tc.tctx.Sandbox
+}
+
+// keepsSandbox reports whether the test case's sandbox is kept if it fails.
+func (tc *TestCase) keepsSandbox() bool {
+	if cfg := tc.sandbox(); cfg != nil && cfg.KeepOnFailure {
+		return true
+	}
+
+	return tc.keepSandbox || tc.tctx.keepSandbox
+}
+
+// setUpSandbox creates the test case's sandbox, if it has one, and arranges
+// for the command to run inside it.
+func (tc *TestCase) setUpSandbox() (*sandbox, error) {
+	var s *sandbox
+	var err error
+	if tc.sharedSandbox != nil {
+		if s, err = tc.sharedSandbox.acquire(tc.resetsSandbox); err != nil {
+			return nil, err
+		}
+	} else if cfg := tc.sandbox(); cfg != nil {
+		s, err = newSandbox(cfg.Fixture)
+	} else {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("create sandbox: %w", err)
+	}
+
+	for _, stage := range tc.Pipeline {
+		s.apply(stage.cmd)
+	}
+
+	if tc.Pipeline == nil {
+		s.apply(tc.cmd)
+	}
+
+	return s, nil
+}
+
+// tearDownSandbox removes the sandbox, unless the test case failed and is
+// configured to keep it. A shared sandbox is released when any test case
+// using it fails, so that it isn't left behind if the test cases after it
+// don't run.
+func (tc *TestCase) tearDownSandbox(t *testing.T, s *sandbox, result *TestResult) {
+	if s == nil {
+		return
+	}
+
+	failed := len(result.errors) > 0
+	if failed && tc.keepsSandbox() {
+		if t != nil {
+			t.Logf("keeping sandbox %s", s.root)
+		}
+
+		if tc.sharedSandbox != nil {
+			tc.sharedSandbox.release(true, true)
+		}
+
+		return
+	}
+
+	tc.discardSandbox(s, failed)
+}
+
+// discardSandbox removes the sandbox. A shared sandbox is only removed by the
+// last test case that uses it, or by one that failed.
+func (tc *TestCase) discardSandbox(s *sandbox, failed bool) {
+	if tc.sharedSandbox != nil {
+		if failed || tc.releasesSandbox {
+			tc.sharedSandbox.release(false, failed)
+		}
+
+		return
+	}
+
+	if s != nil {
+		s.remove()
+	}
+}
+
+// A sharedSandbox is a sandbox used by a sequence of test cases, such as the
+// commands of a test script, so that each sees the files written by those
+// before it. It is created afresh by the first test case and removed by the
+// last, or by the first to fail, after which the remaining test cases fail
+// until the sequence is run again from the start.
+type sharedSandbox struct {
+	mu      sync.Mutex
+	fixture string
+	sandbox *sandbox
+	failed  bool
+}
+
+// acquire returns the shared sandbox, creating it if necessary. The first
+// test case of the sequence passes reset, which replaces any sandbox left
+// behind by an earlier run.
+func (s *sharedSandbox) acquire(reset bool) (*sandbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reset {
+		if s.sandbox != nil {
+			s.sandbox.remove()
+			s.sandbox = nil
+		}
+
+		s.failed = false
+	}
+
+	if s.failed {
+		return nil, errors.New("skipped because an earlier test case sharing its sandbox failed")
+	}
+
+	if s.sandbox == nil {
+		sandbox, err := newSandbox(s.fixture)
+		if err != nil {
+			return nil, fmt.Errorf("create sandbox: %w", err)
+		}
+
+		s.sandbox = sandbox
+	}
+
+	return s.sandbox, nil
+}
+
+// release removes the sandbox, or only forgets it if keep is set. If failed
+// is set, the remaining test cases of the sequence are skipped.
+func (s *sharedSandbox) release(keep, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sandbox != nil && !keep {
+		s.sandbox.remove()
+	}
+
+	s.sandbox = nil
+	s.failed = s.failed || failed
+}
+
+// A sandbox is a temporary directory tree in which a command is run.
+//
+//	<root>/work   the command's working directory, containing the fixture
+//	<root>/home   HOME and the XDG base directories
+//	<root>/tmp    TMPDIR
+type sandbox struct {
+	root string
+	work string
+	home string
+	tmp  string
+}
+
+func newSandbox(fixture string) (*sandbox, error) {
+	root, err := os.MkdirTemp("", "melatonin-exec-")
+	if err != nil {
+		return nil, err
+	}
+
+	// resolve symlinks (e.g. /tmp on macOS) so that paths reported by
+	// commands match the sandbox's paths
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	s := &sandbox{
+		root: root,
+		work: filepath.Join(root, "work"),
+		home: filepath.Join(root, "home"),
+		tmp:  filepath.Join(root, "tmp"),
+	}
+
+	for _, dir := range append([]string{s.work, s.tmp}, s.xdgDirs()...) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			s.remove()
+			return nil, err
+		}
+	}
+
+	if err := s.populate(fixture); err != nil {
+		s.remove()
+		return nil, fmt.Errorf("fixture %s: %w", fixture, err)
+	}
+
+	return s, nil
+}
+
+// apply arranges for cmd to run inside the sandbox. The sandbox's environment
+// is applied separately, as part of the command's environment.
+func (s *sandbox) apply(cmd *osexec.Cmd) {
+	if !filepath.IsAbs(cmd.Dir) {
+		cmd.Dir = filepath.Join(s.work, cmd.Dir)
+	}
+}
+
+func (s *sandbox) populate(fixture string) error {
+	if fixture == "" {
+		return nil
+	}
+
+	if strings.HasSuffix(fixture, ".txtar") {
+		b, err := os.ReadFile(fixture)
+		if err != nil {
+			return err
+		}
+
+		return extractTxtar(b, s.work)
+	}
+
+	return copyTree(fixture, s.work)
+}
+
+func (s *sandbox) xdgDirs() []string {
+	return []string{
+		filepath.Join(s.home, ".config"),
+		filepath.Join(s.home, ".cache"),
+		filepath.Join(s.home, ".local", "share"),
+		filepath.Join(s.home, ".local", "state"),
+	}
+}
+
+// env returns the environment variables that isolate a command from the
+// user's home directory.
+func (s *sandbox) env() map[string]string {
+	dirs := s.xdgDirs()
+	return map[string]string{
+		"HOME":            s.home,
+		"USERPROFILE":     s.home,
+		"TMPDIR":          s.tmp,
+		"XDG_CONFIG_HOME": dirs[0],
+		"XDG_CACHE_HOME":  dirs[1],
+		"XDG_DATA_HOME":   dirs[2],
+		"XDG_STATE_HOME":  dirs[3],
+	}
+}
+
+// dir returns the root of the sandbox, or an empty string if s is nil.
+func (s *sandbox) dir() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.root
+}
+
+func (s *sandbox) remove() error {
+	return os.RemoveAll(s.root)
+}
+
+// copyTree copies the directory tree rooted at src into dst, preserving file
+// modes and symbolic links.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,57 @@
+package exec
+
+import (
+	"os"
+	"testing"
+)
+
+func TestKeepSandboxOnFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		tc   *TestCase
+		keep bool
+	}{
+		{
+			name: "passing test case",
+			tc:   Run("true").WithSandbox("").KeepSandboxOnFailure(),
+			keep: false,
+		},
+		{
+			name: "failing test case",
+			tc:   Run("false").WithSandbox("").KeepSandboxOnFailure(),
+			keep: true,
+		},
+		{
+			name: "kept before the sandbox is configured",
+			tc:   Run("false").KeepSandboxOnFailure().WithSandbox(""),
+			keep: true,
+		},
+		{
+			name: "context kept before its sandbox is configured",
+			tc:   NewTestContext().KeepSandboxOnFailure().WithSandbox("").Run("false"),
+			keep: true,
+		},
+		{
+			name: "not kept",
+			tc:   Run("false").WithSandbox(""),
+			keep: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.tc.Execute(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := result.(*TestResult).SandboxDir
+			defer os.RemoveAll(dir)
+
+			_, err = os.Stat(dir)
+			if kept := err == nil; kept != tt.keep {
+				t.Errorf("sandbox kept = %t, want %t", kept, tt.keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jefflinse/melatonin/mt"
+)
+
+// LoadScripts loads the test scripts in dir using the default context. See
+// TestContext.LoadScripts.
+func LoadScripts(dir string) ([]mt.TestCase, error) {
+	return DefaultContext().LoadScripts(dir)
+}
+
+// LoadScripts loads every test script (a file ending in ".txtar") in dir, in
+// lexical order, and returns the test cases they describe. See LoadScript.
+func (c *TestContext) LoadScripts(dir string) ([]mt.TestCase, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txtar"))
+	if err != nil {
+		return nil, err
+	}
+
+	var tests []mt.TestCase
+	for _, path := range paths {
+		script, err := c.LoadScript(path)
+		if err != nil {
+			return nil, err
+		}
+
+		tests = append(tests, script...)
+	}
+
+	return tests, nil
+}
+
+// LoadScript loads a test script and returns a test case for each command it
+// runs. Each test case is a *TestCase created from this context.
+//
+// A test script is a txtar archive whose comment is a script and whose files
+// are copied into a sandbox. The script's commands run in order in the same
+// sandbox, so each command sees the files written by those before it. The
+// sandbox is removed after the last command, or as soon as a command fails,
+// in which case the remaining commands fail without running; running the
+// first command again starts over with a fresh sandbox.
+//
+// Commands are run as by TestContext.Run, so if the context has a Binary,
+// exec runs it when given its name (such as "mytool" for a binary built from
+// ./cmd/mytool).
+//
+// Each line of the script is a directive; blank lines and lines starting
+// with # are ignored. Arguments are separated by spaces and may be quoted
+// with single or double quotes.
+//
+//	env KEY=VALUE...      set environment variables for subsequent commands
+//	unenv KEY...          unset environment variables for subsequent commands
+//	stdin FILE            use the contents of FILE as the next command's stdin
+//	exec NAME [ARG...]    run a command, which is expected to exit with code 0
+//	status CODE           expect the last command to exit with CODE instead
+//	stdout PATTERN        expect the last command's stdout to match PATTERN
+//	stderr PATTERN        expect the last command's stderr to match PATTERN
+//	cmp stdout FILE       expect the last command's stdout to equal FILE
+//	cmp stderr FILE       expect the last command's stderr to equal FILE
+//	cmp PATH FILE         expect the file at PATH to equal FILE
+//	[!] exists PATH...    expect files to exist (or not) after the last command
+//
+// FILE refers to a file in the archive, and PATH to a path relative to the
+// command's working directory. For example:
+//
+//	env NAME=World
+//	exec greet
+//	cmp stdout want.txt
+//	exec greet --shout
+//	stdout '^HELLO'
+//	! exists greet.log
+//
+//	-- want.txt --
+//	Hello, World!
+func (c *TestContext) LoadScript(path string) ([]mt.TestCase, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script, files := parseTxtar(b)
+	p := &scriptParser{
+		ctx:     c,
+		path:    path,
+		files:   map[string]string{},
+		env:     map[string]string{},
+		sandbox: &sharedSandbox{fixture: path},
+	}
+
+	for _, f := range files {
+		p.files[f.name] = f.data
+	}
+
+	for i, line := range splitLines(script) {
+		p.line = i + 1
+		if err := p.parseLine(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, p.line, err)
+		}
+	}
+
+	if len(p.tests) > 0 {
+		p.tests[0].(*TestCase).resetsSandbox = true
+		p.last.releasesSandbox = true
+	}
+
+	return p.tests, nil
+}
+
+// A scriptParser turns the lines of a test script into test cases.
+type scriptParser struct {
+	ctx     *TestContext
+	path    string
+	line    int
+	files   map[string]string
+	env     map[string]string
+	unset   []string
+	stdin   *string
+	sandbox *sharedSandbox
+	last    *TestCase
+	tests   []mt.TestCase
+}
+
+func (p *scriptParser) parseLine(line string) error {
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return nil
+	}
+
+	words, err := splitScriptLine(line)
+	if err != nil || len(words) == 0 {
+		return err
+	}
+
+	negate := words[0] == "!"
+	if negate {
+		if words = words[1:]; len(words) == 0 || words[0] != "exists" {
+			return fmt.Errorf("! can only be used with exists")
+		}
+	}
+
+	name, args := words[0], words[1:]
+	switch name {
+	case "env":
+		for _, kv := range args {
+			if !strings.Contains(kv, "=") {
+				return fmt.Errorf("env: expected KEY=VALUE, got %q", kv)
+			}
+
+			k, v := splitEnvVar(kv)
+			p.env, p.unset = setEnv(p.env, p.unset, map[string]string{k: v})
+		}
+
+	case "unenv":
+		p.env, p.unset = unsetEnv(p.env, p.unset, args)
+
+	case "stdin":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: stdin FILE")
+		}
+
+		data, err := p.file(args[0])
+		if err != nil {
+			return err
+		}
+
+		p.stdin = &data
+
+	case "exec":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: exec NAME [ARG...]")
+		}
+
+		desc := fmt.Sprintf("%s:%d: %s", filepath.Base(p.path), p.line, strings.Join(words, " "))
+		tc := p.ctx.Run(args[0], desc).
+			WithArgs(args[1:]...).
+			WithEnvVars(p.env).
+			WithoutEnvVars(p.unset...).
+			ExpectExitCode(0)
+
+		tc.sharedSandbox = p.sandbox
+
+		if p.stdin != nil {
+			tc.WithStdin(strings.NewReader(*p.stdin))
+			p.stdin = nil
+		}
+
+		p.last = tc
+		p.tests = append(p.tests, tc)
+
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: status CODE")
+		}
+
+		code, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("status: invalid exit code %q", args[0])
+		}
+
+		return p.expect(func(tc *TestCase) { tc.ExpectExitCode(code) })
+
+	case "stdout", "stderr":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s PATTERN", name)
+		}
+
+		pattern, err := regexp.Compile("(?m)" + args[0])
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if name == "stdout" {
+			return p.expect(func(tc *TestCase) { tc.ExpectStdoutMatches(pattern) })
+		}
+
+		return p.expect(func(tc *TestCase) { tc.ExpectStderrMatches(pattern) })
+
+	case "cmp":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: cmp stdout|stderr|PATH FILE")
+		}
+
+		want, err := p.file(args[1])
+		if err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "stdout":
+			return p.expect(func(tc *TestCase) { tc.ExpectStdout(want) })
+		case "stderr":
+			return p.expect(func(tc *TestCase) { tc.ExpectStderr(want) })
+		default:
+			return p.expect(func(tc *TestCase) { tc.ExpectFileContents(args[0], want) })
+		}
+
+	case "exists":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: [!] exists PATH...")
+		}
+
+		return p.expect(func(tc *TestCase) {
+			for _, path := range args {
+				if negate {
+					tc.ExpectNoFile(path)
+				} else {
+					tc.ExpectFile(path)
+				}
+			}
+		})
+
+	default:
+		return fmt.Errorf("unknown directive %q", name)
+	}
+
+	return nil
+}
+
+// expect adds an expectation to the last command.
+func (p *scriptParser) expect(add func(tc *TestCase)) error {
+	if p.last == nil {
+		return fmt.Errorf("expectation before any exec")
+	}
+
+	add(p.last)
+	return nil
+}
+
+func (p *scriptParser) file(name string) (string, error) {
+	data, ok := p.files[name]
+	if !ok {
+		return "", fmt.Errorf("no file %q in archive", name)
+	}
+
+	return data, nil
+}
+
+// splitScriptLine splits a line of a test script into words. Single quotes
+// preserve their contents literally; within double quotes, a backslash
+// escapes the following character.
+func splitScriptLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range strings.TrimRight(line, "\r\n") {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
@@ -0,0 +1,126 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jefflinse/melatonin/mt"
+)
+
+func TestSplitScriptLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		words []string
+		err   bool
+	}{
+		{line: "", words: nil},
+		{line: "exec greet", words: []string{"exec", "greet"}},
+		{line: "  exec \t greet  \n", words: []string{"exec", "greet"}},
+		{line: "stdout 'hello world'", words: []string{"stdout", "hello world"}},
+		{line: `stdout 'a\b'`, words: []string{"stdout", `a\b`}},
+		{line: `stdout "say \"hi\""`, words: []string{"stdout", `say "hi"`}},
+		{line: `exec echo "it's"`, words: []string{"exec", "echo", "it's"}},
+		{line: `exec echo a'b c'd`, words: []string{"exec", "echo", "ab cd"}},
+		{line: `exec echo ''`, words: []string{"exec", "echo", ""}},
+		{line: "exec echo 'unterminated", err: true},
+		{line: `exec echo "unterminated`, err: true},
+	}
+
+	for _, tt := range tests {
+		words, err := splitScriptLine(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("splitScriptLine(%q) = %q, want an error", tt.line, words)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("splitScriptLine(%q): %s", tt.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(words, tt.words) {
+			t.Errorf("splitScriptLine(%q) = %q, want %q", tt.line, words, tt.words)
+		}
+	}
+}
+
+func TestScriptSandbox(t *testing.T) {
+	dir := t.TempDir()
+	load := func(name, script string) []mt.TestCase {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tests, err := NewTestContext().LoadScript(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return tests
+	}
+
+	execute := func(tc mt.TestCase) *TestResult {
+		result, err := tc.Execute(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return result.(*TestResult)
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	t.Run("failure removes the sandbox", func(t *testing.T) {
+		tests := load("fail.txtar", "exec sh -c 'touch made.txt; exit 1'\nexec true\n")
+
+		result := execute(tests[0])
+		if len(result.Errors()) == 0 {
+			t.Fatal("expected the first command to fail")
+		}
+
+		if exists(result.SandboxDir) {
+			t.Errorf("sandbox %s was not removed", result.SandboxDir)
+		}
+
+		if _, err := tests[1].Execute(t); err == nil {
+			t.Error("expected the second command to be skipped")
+		}
+	})
+
+	t.Run("first command starts over", func(t *testing.T) {
+		tests := load("rerun.txtar", "exec rm seed.txt\nexec true\n-- seed.txt --\nseed\n")
+
+		first := execute(tests[0])
+		if errs := first.Errors(); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+
+		// the first command runs again before the script has finished
+		second := execute(tests[0])
+		if errs := second.Errors(); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+
+		if exists(first.SandboxDir) {
+			t.Errorf("sandbox %s was not removed", first.SandboxDir)
+		}
+
+		last := execute(tests[1])
+		if errs := last.Errors(); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+
+		if exists(second.SandboxDir) {
+			t.Errorf("sandbox %s was not removed", second.SandboxDir)
+		}
+	})
+}
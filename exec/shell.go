@@ -0,0 +1,42 @@
+package exec
+
+import (
+	osexec "os/exec"
+)
+
+// defaultShell is the shell used to run scripts unless a context configures
+// another.
+var defaultShell = []string{"sh", "-c"}
+
+// WithShell sets the command used to run scripts passed to Shell. The script
+// is appended as the final argument, so the command should end with the
+// shell's option for reading a script from its arguments. The default is
+// "sh -c".
+//
+//	ctx := exec.NewTestContext().WithShell("bash", "-euo", "pipefail", "-c")
+func (c *TestContext) WithShell(shell ...string) *TestContext {
+	c.ShellCommand = shell
+	return c
+}
+
+// Shell returns a test case that runs script using the default context. See
+// TestContext.Shell.
+func Shell(script string, description ...string) *TestCase {
+	return DefaultContext().Shell(script, description...)
+}
+
+// Shell returns a test case that runs script with the context's shell. The
+// test case supports the same environment, sandbox and expectations as one
+// created by Run, and its target is the script itself. Arguments added with
+// WithArgs follow the script, so with "sh -c" they become $0, $1 and so on.
+func (c *TestContext) Shell(script string, description ...string) *TestCase {
+	shell := c.ShellCommand
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+
+	cmd := osexec.Command(shell[0], append(shell[1:len(shell):len(shell)], script)...)
+	tc := c.newTestCase(cmd, description...)
+	tc.Script = script
+	return tc
+}
@@ -0,0 +1,420 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Stub is a fake executable that is placed at the front of the PATH of a
+// command, standing in for a real program the command invokes.
+type Stub struct {
+	Name      string
+	Responses []StubResponse
+}
+
+// A StubResponse is what a stub does when its arguments match Args, a shell
+// glob matched against the arguments joined by spaces. Only * and ? are
+// special; an empty Args matches any arguments. The first matching response
+// is used.
+type StubResponse struct {
+	Args     string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// A StubCall is a recorded invocation of a stub. Stdin is only recorded for
+// stubs with an ExpectStubStdin expectation, and is otherwise empty.
+type StubCall struct {
+	Name  string
+	Args  []string
+	Stdin string
+}
+
+// A StubExpectation describes an expected invocation of a stub. If Args is
+// nil, a call with any arguments matches; if Stdin is nil, a call with any
+// stdin matches.
+type StubExpectation struct {
+	Name      string
+	Args      []string
+	Stdin     *string
+	NotCalled bool
+}
+
+// WithStub adds a stub for every test case in this context. See
+// TestCase.WithStub.
+func (c *TestContext) WithStub(name string, responses ...StubResponse) *TestContext {
+	c.Stubs = addStub(c.Stubs, name, responses)
+	return c
+}
+
+// WithStub creates a fake executable called name in a directory prepended to
+// the command's PATH. Each time it's run, the stub records its arguments,
+// then writes the stdout and stderr of the first response whose Args
+// match and exits with its exit code. If no response matches, it exits with
+// code 127. A stub added to a test case replaces a stub of the same name
+// added to its context.
+//
+// Stubs are shell scripts, so are not supported on Windows.
+//
+//	exec.Run("deploy").
+//		WithStub("git", exec.StubResponse{Args: "rev-parse *", Stdout: "abc123\n"}).
+//		WithStub("kubectl", exec.StubResponse{}).
+//		ExpectStubCalledWith("kubectl", "set", "image", "deployment/app", "app=app:abc123")
+func (tc *TestCase) WithStub(name string, responses ...StubResponse) *TestCase {
+	tc.Stubs = addStub(tc.Stubs, name, responses)
+	return tc
+}
+
+func addStub(stubs []*Stub, name string, responses []StubResponse) []*Stub {
+	for _, s := range stubs {
+		if s.Name == name {
+			s.Responses = append(s.Responses, responses...)
+			return stubs
+		}
+	}
+
+	return append(stubs, &Stub{Name: name, Responses: responses})
+}
+
+// ExpectStubCalled expects the stub to have been called at least once.
+func (tc *TestCase) ExpectStubCalled(name string) *TestCase {
+	tc.Expectations.Stubs = append(tc.Expectations.Stubs, &StubExpectation{Name: name})
+	return tc
+}
+
+// ExpectStubCalledWith expects the stub to have been called with exactly
+// the given arguments.
+func (tc *TestCase) ExpectStubCalledWith(name string, args ...string) *TestCase {
+	if args == nil {
+		args = []string{}
+	}
+
+	tc.Expectations.Stubs = append(tc.Expectations.Stubs, &StubExpectation{Name: name, Args: args})
+	return tc
+}
+
+// ExpectStubStdin expects the stub to have been called with stdin as its
+// input. Stubs only read their stdin if they have this expectation; other
+// stubs leave it for the command.
+func (tc *TestCase) ExpectStubStdin(name string, stdin string) *TestCase {
+	tc.Expectations.Stubs = append(tc.Expectations.Stubs, &StubExpectation{Name: name, Stdin: &stdin})
+	return tc
+}
+
+// ExpectStubNotCalled expects the stub not to have been called.
+func (tc *TestCase) ExpectStubNotCalled(name string) *TestCase {
+	tc.Expectations.Stubs = append(tc.Expectations.Stubs, &StubExpectation{Name: name, NotCalled: true})
+	return tc
+}
+
+func (e *StubExpectation) matches(call StubCall) bool {
+	if call.Name != e.Name {
+		return false
+	}
+
+	if e.Args != nil {
+		if len(call.Args) != len(e.Args) {
+			return false
+		}
+
+		for i := range e.Args {
+			if call.Args[i] != e.Args[i] {
+				return false
+			}
+		}
+	}
+
+	return e.Stdin == nil || call.Stdin == *e.Stdin
+}
+
+func (r *TestResult) validateStub(e *StubExpectation) {
+	var calls []StubCall
+	for _, call := range r.StubCalls {
+		if e.matches(call) {
+			calls = append(calls, call)
+		}
+	}
+
+	switch {
+	case e.NotCalled && len(calls) > 0:
+		r.errors = append(r.errors, fmt.Errorf("expected stub %s not to be called, called with %q", e.Name, calls[0].Args))
+	case !e.NotCalled && len(calls) == 0:
+		var desc string
+		if e.Args != nil {
+			desc += fmt.Sprintf(" with args %q", e.Args)
+		}
+
+		if e.Stdin != nil {
+			desc += fmt.Sprintf(" with stdin %q", *e.Stdin)
+		}
+
+		var got []string
+		for _, call := range r.StubCalls {
+			if call.Name == e.Name {
+				got = append(got, fmt.Sprintf("%q", call.Args))
+			}
+		}
+
+		if len(got) == 0 {
+			r.errors = append(r.errors, fmt.Errorf("expected stub %s to be called%s, but it was not called", e.Name, desc))
+		} else {
+			r.errors = append(r.errors, fmt.Errorf("expected stub %s to be called%s, got calls with args %s", e.Name, desc, strings.Join(got, ", ")))
+		}
+	}
+}
+
+// stubs returns the stubs for the test case and, for a pipeline, its stages.
+// Stubs added to a test case replace those of the same name added to its
+// context.
+func (tc *TestCase) stubs() []*Stub {
+	var stubs []*Stub
+	seen := map[string]int{}
+	add := func(list []*Stub) {
+		for _, s := range list {
+			if i, ok := seen[s.Name]; ok {
+				stubs[i] = s
+				continue
+			}
+
+			seen[s.Name] = len(stubs)
+			stubs = append(stubs, s)
+		}
+	}
+
+	cases := append([]*TestCase{tc}, tc.Pipeline...)
+	for _, c := range cases {
+		if c.tctx != nil {
+			add(c.tctx.Stubs)
+		}
+	}
+
+	for _, c := range cases {
+		add(c.Stubs)
+	}
+
+	return stubs
+}
+
+// stubStdin returns the names of the stubs whose stdin the test case, or one
+// of its pipeline's stages, expects.
+func (tc *TestCase) stubStdin() map[string]bool {
+	names := map[string]bool{}
+	for _, c := range append([]*TestCase{tc}, tc.Pipeline...) {
+		for _, e := range c.Expectations.Stubs {
+			if e.Stdin != nil {
+				names[e.Name] = true
+			}
+		}
+	}
+
+	return names
+}
+
+// A stubDir holds the stubs for a run of a test case, and the record of
+// their invocations.
+//
+//	<root>/bin                  the stubs, prepended to PATH
+//	<root>/responses/<name>/N   the stdout and stderr of each response
+//	<root>/calls/N              the name, args and stdin of each invocation
+type stubDir struct {
+	root string
+}
+
+func (d *stubDir) bin() string {
+	return filepath.Join(d.root, "bin")
+}
+
+// newStubDir creates the stubs. Those named in readStdin read and record
+// their stdin.
+func newStubDir(stubs []*Stub, readStdin map[string]bool) (*stubDir, error) {
+	if len(stubs) == 0 {
+		return nil, nil
+	}
+
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("stubs are not supported on Windows")
+	}
+
+	root, err := os.MkdirTemp("", "melatonin-stubs-")
+	if err != nil {
+		return nil, fmt.Errorf("create stubs: %w", err)
+	}
+
+	d := &stubDir{root: root}
+	for _, dir := range []string{d.bin(), filepath.Join(root, "calls")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			d.remove()
+			return nil, fmt.Errorf("create stubs: %w", err)
+		}
+	}
+
+	for _, s := range stubs {
+		if err := d.write(s, readStdin[s.Name]); err != nil {
+			d.remove()
+			return nil, fmt.Errorf("create stub %s: %w", s.Name, err)
+		}
+	}
+
+	return d, nil
+}
+
+// write creates the stub's script and response files.
+func (d *stubDir) write(s *Stub, readStdin bool) error {
+	if s.Name == "" || strings.ContainsAny(s.Name, `/\`) {
+		return fmt.Errorf("invalid stub name %q", s.Name)
+	}
+
+	responses := filepath.Join(d.root, "responses", s.Name)
+	if err := os.MkdirAll(responses, 0755); err != nil {
+		return err
+	}
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, `#!/bin/sh
+PATH="$PATH:/usr/bin:/bin"
+stub=%s
+i=1
+until mkdir "$stub/calls/$i" 2>/dev/null; do
+	[ -e "$stub/calls/$i" ] || exit 127
+	i=$((i+1))
+done
+call="$stub/calls/$i"
+printf '%%s' %s > "$call/name"
+: > "$call/args"
+[ $# -eq 0 ] || printf '%%s\0' "$@" > "$call/args"
+: > "$call/stdin"
+`, shellQuote(d.root), shellQuote(s.Name))
+
+	if readStdin {
+		script.WriteString(`[ -t 0 ] || cat > "$call/stdin"` + "\n")
+	}
+
+	script.WriteString("case \"$*\" in\n")
+
+	for i, resp := range s.Responses {
+		prefix := filepath.Join(responses, strconv.Itoa(i+1))
+		if err := os.WriteFile(prefix+".stdout", []byte(resp.Stdout), 0644); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(prefix+".stderr", []byte(resp.Stderr), 0644); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(script, "%s) cat %s; cat %s >&2; exit %d ;;\n",
+			globPattern(resp.Args), shellQuote(prefix+".stdout"), shellQuote(prefix+".stderr"), resp.ExitCode)
+	}
+
+	fmt.Fprintf(script, "esac\necho %s >&2\nexit 127\n", shellQuote("stub "+s.Name+": no response for arguments: ")+`"$*"`)
+
+	return os.WriteFile(filepath.Join(d.bin(), s.Name), []byte(script.String()), 0755)
+}
+
+// calls returns the recorded invocations of the stubs, in the order they
+// started.
+func (d *stubDir) calls() ([]StubCall, error) {
+	dir := filepath.Join(d.root, "calls")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil {
+			seqs = append(seqs, n)
+		}
+	}
+	sort.Ints(seqs)
+
+	var calls []StubCall
+	for _, n := range seqs {
+		call := filepath.Join(dir, strconv.Itoa(n))
+		name, err := os.ReadFile(filepath.Join(call, "name"))
+		if err != nil {
+			return nil, err
+		}
+
+		args, err := os.ReadFile(filepath.Join(call, "args"))
+		if err != nil {
+			return nil, err
+		}
+
+		stdin, err := os.ReadFile(filepath.Join(call, "stdin"))
+		if err != nil {
+			return nil, err
+		}
+
+		c := StubCall{Name: string(name), Args: []string{}, Stdin: string(stdin)}
+		if len(args) > 0 {
+			c.Args = strings.Split(strings.TrimSuffix(string(args), "\x00"), "\x00")
+		}
+
+		calls = append(calls, c)
+	}
+
+	return calls, nil
+}
+
+// remove removes the stubs, if there are any.
+func (d *stubDir) remove() {
+	if d != nil {
+		os.RemoveAll(d.root)
+	}
+}
+
+// recordStubCalls sets the result's stub calls from d, if there are stubs.
+func (r *TestResult) recordStubCalls(d *stubDir) {
+	if d == nil {
+		return
+	}
+
+	calls, err := d.calls()
+	if err != nil {
+		r.errors = append(r.errors, fmt.Errorf("read stub calls: %w", err))
+	}
+
+	r.StubCalls = calls
+}
+
+// shellQuote quotes s for use as a single word in a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// globPattern converts a stub response's Args into a shell case pattern in
+// which only * and ? are special.
+func globPattern(args string) string {
+	if args == "" {
+		return "*"
+	}
+
+	b := &strings.Builder{}
+	literal := ""
+	for _, r := range args {
+		if r == '*' || r == '?' {
+			if literal != "" {
+				b.WriteString(shellQuote(literal))
+				literal = ""
+			}
+
+			b.WriteRune(r)
+			continue
+		}
+
+		literal += string(r)
+	}
+
+	if literal != "" {
+		b.WriteString(shellQuote(literal))
+	}
+
+	return b.String()
+}
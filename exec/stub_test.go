@@ -0,0 +1,26 @@
+package exec
+
+import "testing"
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"", "*"},
+		{"status", "'status'"},
+		{"log --oneline", "'log --oneline'"},
+		{"*", "*"},
+		{"log *", "'log '*"},
+		{"*.go", "*'.go'"},
+		{"a?c", "'a'?'c'"},
+		{"[abc] $HOME", "'[abc] $HOME'"},
+		{"it's", `'it'\''s'`},
+	}
+
+	for _, tt := range tests {
+		if got := globPattern(tt.args); got != tt.want {
+			t.Errorf("globPattern(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
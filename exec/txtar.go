@@ -0,0 +1,71 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A txtarFile is a file in a txtar archive.
+type txtarFile struct {
+	name string
+	data string
+}
+
+// parseTxtar splits a txtar archive into its leading comment and its files.
+//
+// See https://pkg.go.dev/golang.org/x/tools/txtar for a description of the
+// format.
+func parseTxtar(archive []byte) (string, []txtarFile) {
+	var comment strings.Builder
+	var files []txtarFile
+	for _, line := range splitLines(string(archive)) {
+		if name, ok := txtarFileMarker(line); ok {
+			files = append(files, txtarFile{name: name})
+			continue
+		}
+
+		if len(files) == 0 {
+			comment.WriteString(line)
+		} else {
+			files[len(files)-1].data += line
+		}
+	}
+
+	return comment.String(), files
+}
+
+// extractTxtar writes the files in a txtar archive into dir. The archive's
+// leading comment is ignored.
+func extractTxtar(archive []byte, dir string) error {
+	_, files := parseTxtar(archive)
+	for _, f := range files {
+		clean := filepath.Clean(filepath.FromSlash(f.name))
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("txtar file %q is outside the archive", f.name)
+		}
+
+		path := filepath.Join(dir, clean)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(path, []byte(f.data), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// txtarFileMarker parses a "-- name --" file marker line.
+func txtarFileMarker(line string) (string, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "-- ") || !strings.HasSuffix(line, " --") || len(line) < len("-- x --") {
+		return "", false
+	}
+
+	name := strings.TrimSpace(line[3 : len(line)-3])
+	return name, name != ""
+}
@@ -0,0 +1,71 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTxtar(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		comment string
+		files   []txtarFile
+	}{
+		{
+			name:    "comment only",
+			archive: "exec greet\n",
+			comment: "exec greet\n",
+		},
+		{
+			name:    "files",
+			archive: "exec greet\n-- a.txt --\nhello\n-- dir/b.txt --\n\nworld\n",
+			comment: "exec greet\n",
+			files: []txtarFile{
+				{name: "a.txt", data: "hello\n"},
+				{name: "dir/b.txt", data: "\nworld\n"},
+			},
+		},
+		{
+			name:    "no comment",
+			archive: "-- a.txt --\nhello\n",
+			files:   []txtarFile{{name: "a.txt", data: "hello\n"}},
+		},
+		{
+			name:    "empty file",
+			archive: "-- a.txt --\n-- b.txt --\nb\n",
+			files: []txtarFile{
+				{name: "a.txt"},
+				{name: "b.txt", data: "b\n"},
+			},
+		},
+		{
+			name:    "missing final newline",
+			archive: "-- a.txt --\nhello",
+			files:   []txtarFile{{name: "a.txt", data: "hello"}},
+		},
+		{
+			name:    "CRLF markers",
+			archive: "-- a.txt --\r\nhello\r\n",
+			files:   []txtarFile{{name: "a.txt", data: "hello\r\n"}},
+		},
+		{
+			name:    "not markers",
+			archive: "-- --\n--a.txt--\n-- a.txt\n",
+			comment: "-- --\n--a.txt--\n-- a.txt\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comment, files := parseTxtar([]byte(tt.archive))
+			if comment != tt.comment {
+				t.Errorf("comment = %q, want %q", comment, tt.comment)
+			}
+
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("files = %+v, want %+v", files, tt.files)
+			}
+		})
+	}
+}